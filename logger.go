@@ -0,0 +1,28 @@
+package goutil
+
+import (
+	"sync"
+
+	"github.com/NovanHsiu/goutil/logger"
+)
+
+var (
+	packageLoggerMu sync.RWMutex
+	packageLogger   = logger.NewNopLogger()
+)
+
+// SetLogger set the logger of goutil package, a nil logger discards everything, which is the default
+func SetLogger(l logger.Logger) {
+	if l == nil {
+		l = logger.NewNopLogger()
+	}
+	packageLoggerMu.Lock()
+	defer packageLoggerMu.Unlock()
+	packageLogger = l
+}
+
+func getLogger() logger.Logger {
+	packageLoggerMu.RLock()
+	defer packageLoggerMu.RUnlock()
+	return packageLogger
+}
@@ -0,0 +1,182 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "level(" + strconv.Itoa(int(l)) + ")"
+}
+
+// Logger write leveled log with key/value fields, e.g.
+//
+//	log.Error("http client do error", "url", url, "error", err)
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// NewNopLogger create a logger which discards everything
+func NewNopLogger() Logger {
+	return nopLogger{}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, keysAndValues ...interface{}) {}
+func (nopLogger) Info(msg string, keysAndValues ...interface{})  {}
+func (nopLogger) Warn(msg string, keysAndValues ...interface{})  {}
+func (nopLogger) Error(msg string, keysAndValues ...interface{}) {}
+
+// NewTextLogger create a logger writing one line per entry, e.g.
+//
+//	2021-06-30T15:04:05+08:00 ERROR http client do error url=http://localhost error="connection refused"
+func NewTextLogger(w io.Writer, level Level) Logger {
+	return &writerLogger{w: w, level: level, format: formatText}
+}
+
+// NewJSONLogger create a logger writing one json object per line, e.g.
+//
+//	{"time":"2021-06-30T15:04:05+08:00","level":"error","msg":"http client do error","url":"http://localhost"}
+func NewJSONLogger(w io.Writer, level Level) Logger {
+	return &writerLogger{w: w, level: level, format: formatJSON}
+}
+
+type writerLogger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	level  Level
+	format func(t time.Time, level Level, msg string, keysAndValues []interface{}) []byte
+}
+
+func (l *writerLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.log(LevelDebug, msg, keysAndValues)
+}
+
+func (l *writerLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.log(LevelInfo, msg, keysAndValues)
+}
+
+func (l *writerLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.log(LevelWarn, msg, keysAndValues)
+}
+
+func (l *writerLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.log(LevelError, msg, keysAndValues)
+}
+
+func (l *writerLogger) log(level Level, msg string, keysAndValues []interface{}) {
+	if level < l.level {
+		return
+	}
+	line := l.format(time.Now(), level, msg, keysAndValues)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(line)
+}
+
+// fields pair up keysAndValues, a value without key is put in the key "EXTRA"
+func fields(keysAndValues []interface{}) ([]string, []interface{}) {
+	var keys []string
+	var values []interface{}
+	for i := 0; i < len(keysAndValues); i += 2 {
+		if i+1 >= len(keysAndValues) {
+			keys = append(keys, "EXTRA")
+			values = append(values, fieldValue(keysAndValues[i]))
+			break
+		}
+		keys = append(keys, fmt.Sprint(keysAndValues[i]))
+		values = append(values, fieldValue(keysAndValues[i+1]))
+	}
+	return keys, values
+}
+
+func fieldValue(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case error:
+		return vv.Error()
+	case time.Duration:
+		return vv.String()
+	case fmt.Stringer:
+		return vv.String()
+	}
+	return v
+}
+
+func formatText(t time.Time, level Level, msg string, keysAndValues []interface{}) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString(t.Format(time.RFC3339))
+	buf.WriteByte(' ')
+	buf.WriteString(strings.ToUpper(level.String()))
+	buf.WriteByte(' ')
+	buf.WriteString(msg)
+	keys, values := fields(keysAndValues)
+	for i := range keys {
+		buf.WriteByte(' ')
+		buf.WriteString(keys[i])
+		buf.WriteByte('=')
+		value := fmt.Sprint(values[i])
+		if value == "" || strings.ContainsAny(value, " \t\r\n\"=") {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func formatJSON(t time.Time, level Level, msg string, keysAndValues []interface{}) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString(`{"time":`)
+	writeJSONValue(buf, t.Format(time.RFC3339))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(buf, msg)
+	keys, values := fields(keysAndValues)
+	for i := range keys {
+		buf.WriteByte(',')
+		writeJSONValue(buf, keys[i])
+		buf.WriteByte(':')
+		writeJSONValue(buf, values[i])
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
@@ -0,0 +1,459 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// XFromCache is set to "1" on responses served from the cache
+	XFromCache = "X-From-Cache"
+	// cacheTimeHeader record when the response was received, it is only kept in the storage
+	cacheTimeHeader = "X-Goutil-Cache-Time"
+	// variedHeaderPrefix record the request headers listed in Vary, they are only kept in the storage
+	variedHeaderPrefix = "X-Goutil-Varied-"
+)
+
+// CacheStorage store the serialized responses of the cache
+type CacheStorage interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+	Delete(key string)
+}
+
+// Cache is a private HTTP cache of GET responses following RFC 7234, it honors Cache-Control, Expires,
+// and revalidates stale responses by ETag/If-None-Match and Last-Modified/If-Modified-Since
+type Cache struct {
+	Storage CacheStorage
+	// MaxEntrySize is the max body bytes of a stored response, larger responses are not stored,
+	// default is 10 MB
+	MaxEntrySize int64
+}
+
+// NewCache create a cache with storage
+func NewCache(storage CacheStorage) *Cache {
+	return &Cache{Storage: storage, MaxEntrySize: 10 << 20}
+}
+
+func (c *Cache) maxEntrySize() int64 {
+	if c.MaxEntrySize <= 0 {
+		return 10 << 20
+	}
+	return c.MaxEntrySize
+}
+
+// cacheKey is the url, and a hash of Authorization and Cookie when the request has them,
+// so callers with different credentials never get the responses of each other
+func cacheKey(req *http.Request) string {
+	auth := req.Header.Values("Authorization")
+	cookies := req.Header.Values("Cookie")
+	if len(auth) == 0 && len(cookies) == 0 {
+		return req.URL.String()
+	}
+	h := sha256.New()
+	io.WriteString(h, strings.Join(auth, "\n"))
+	io.WriteString(h, "\x00")
+	io.WriteString(h, strings.Join(cookies, "\n"))
+	return req.URL.String() + "#" + hex.EncodeToString(h.Sum(nil))
+}
+
+// cachedResponse read the stored response of req, it returns nil when there is none or Vary mismatches
+func (c *Cache) cachedResponse(req *http.Request) (*http.Response, time.Time) {
+	data, ok := c.Storage.Get(cacheKey(req))
+	if !ok {
+		return nil, time.Time{}
+	}
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+	if err != nil {
+		c.Storage.Delete(cacheKey(req))
+		return nil, time.Time{}
+	}
+	for _, name := range headerValues(res.Header, "Vary") {
+		if name == "*" || res.Header.Get(variedHeaderPrefix+name) != req.Header.Get(name) {
+			res.Body.Close()
+			return nil, time.Time{}
+		}
+	}
+	nanos, _ := strconv.ParseInt(res.Header.Get(cacheTimeHeader), 10, 64)
+	storedAt := time.Unix(0, nanos)
+	for key := range res.Header {
+		if key == cacheTimeHeader || strings.HasPrefix(key, variedHeaderPrefix) {
+			res.Header.Del(key)
+		}
+	}
+	return res, storedAt
+}
+
+func (c *Cache) store(req *http.Request, res *http.Response, body []byte) {
+	stored := *res
+	stored.Header = res.Header.Clone()
+	stored.Header.Set(cacheTimeHeader, strconv.FormatInt(time.Now().UnixNano(), 10))
+	stored.Header.Del(XFromCache)
+	for _, name := range headerValues(res.Header, "Vary") {
+		stored.Header.Set(variedHeaderPrefix+name, req.Header.Get(name))
+	}
+	stored.Body = ioutil.NopCloser(bytes.NewReader(body))
+	stored.ContentLength = int64(len(body))
+	stored.TransferEncoding = nil
+	stored.Header.Del("Transfer-Encoding")
+	stored.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	data, err := httputil.DumpResponse(&stored, true)
+	if err != nil {
+		return
+	}
+	c.Storage.Set(cacheKey(req), data)
+}
+
+func headerValues(h http.Header, name string) []string {
+	var values []string
+	for _, line := range h.Values(name) {
+		for _, v := range strings.Split(line, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, http.CanonicalHeaderKey(v))
+			}
+		}
+	}
+	return values
+}
+
+// parseCacheControl parse Cache-Control into directives, e.g. {"max-age": "60", "no-cache": ""}
+func parseCacheControl(h http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, line := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			if eq := strings.Index(part, "="); eq >= 0 {
+				directives[strings.ToLower(strings.TrimSpace(part[:eq]))] = strings.Trim(strings.TrimSpace(part[eq+1:]), `"`)
+			} else {
+				directives[strings.ToLower(part)] = ""
+			}
+		}
+	}
+	return directives
+}
+
+func parseSeconds(value string) (time.Duration, bool) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// isFresh decide whether the stored response can be used without revalidation
+func isFresh(req *http.Request, res *http.Response, storedAt time.Time) bool {
+	reqCC := parseCacheControl(req.Header)
+	resCC := parseCacheControl(res.Header)
+	if _, ok := reqCC["no-cache"]; ok {
+		return false
+	}
+	if _, ok := resCC["no-cache"]; ok {
+		return false
+	}
+	if req.Header.Get("Pragma") == "no-cache" && req.Header.Get("Cache-Control") == "" {
+		return false
+	}
+	age := time.Since(storedAt)
+	if ageHeader, ok := parseSeconds(res.Header.Get("Age")); ok {
+		age += ageHeader
+	}
+	date, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		date = storedAt
+	}
+	var lifetime time.Duration
+	if maxAge, ok := parseSeconds(resCC["max-age"]); ok {
+		lifetime = maxAge
+	} else if expires := res.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return false
+		}
+		lifetime = t.Sub(date)
+	} else if lastModified, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		// heuristic freshness is 10% of the time since the last modification
+		lifetime = date.Sub(lastModified) / 10
+	}
+	if maxAge, ok := parseSeconds(reqCC["max-age"]); ok && maxAge < lifetime {
+		lifetime = maxAge
+	}
+	if minFresh, ok := parseSeconds(reqCC["min-fresh"]); ok {
+		age += minFresh
+	}
+	return lifetime > age
+}
+
+// addedCredentials report whether a middleware inside of the cache, e.g. TokenSource, added or changed
+// the Authorization or Cookie of the request, which are then not in the cache key
+func addedCredentials(req *http.Request, res *http.Response) bool {
+	if res.Request == nil {
+		return false
+	}
+	for _, name := range []string{"Authorization", "Cookie"} {
+		if strings.Join(res.Request.Header.Values(name), "\n") != strings.Join(req.Header.Values(name), "\n") {
+			return true
+		}
+	}
+	return false
+}
+
+func isCacheable(req *http.Request, res *http.Response) bool {
+	if res.StatusCode != http.StatusOK {
+		return false
+	}
+	if _, ok := parseCacheControl(res.Header)["public"]; !ok && addedCredentials(req, res) {
+		// RFC 7234 section 3.2, the cache is shared by the callers of the client
+		return false
+	}
+	if _, ok := parseCacheControl(req.Header)["no-store"]; ok {
+		return false
+	}
+	if _, ok := parseCacheControl(res.Header)["no-store"]; ok {
+		return false
+	}
+	for _, name := range headerValues(res.Header, "Vary") {
+		if name == "*" {
+			return false
+		}
+	}
+	return true
+}
+
+// cachingBody store the response when the body is read to the end and not larger than limit
+type cachingBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+	stored   bool
+	store    func(body []byte)
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.overflow {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.overflow && !b.stored {
+		b.stored = true
+		b.store(b.buf.Bytes())
+	}
+	return n, err
+}
+
+func (c *HttpClient) cacheMiddleware(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		cache := c.Cache
+		if cache == nil || cache.Storage == nil {
+			return next.RoundTrip(req)
+		}
+		if req.Method != http.MethodGet {
+			key := cacheKey(req)
+			res, err := next.RoundTrip(req)
+			if err == nil && req.Method != http.MethodHead && req.Method != http.MethodOptions && res.StatusCode < 400 {
+				// unsafe methods invalidate the stored response
+				cache.Storage.Delete(key)
+			}
+			return res, err
+		}
+		if req.Header.Get("Range") != "" {
+			return next.RoundTrip(req)
+		}
+		if _, ok := parseCacheControl(req.Header)["no-store"]; ok {
+			return next.RoundTrip(req)
+		}
+		cached, storedAt := cache.cachedResponse(req)
+		if cached != nil && isFresh(req, cached, storedAt) {
+			cached.Header.Set(XFromCache, "1")
+			return cached, nil
+		}
+		// the middlewares inside of the cache may change the request, e.g. add Authorization,
+		// so they get a copy and req is kept as the cache looked it up
+		sendReq := req.Clone(req.Context())
+		revalidating := false
+		if cached != nil {
+			etag := cached.Header.Get("ETag")
+			lastModified := cached.Header.Get("Last-Modified")
+			if etag != "" || lastModified != "" {
+				revalidating = true
+				if etag != "" && sendReq.Header.Get("If-None-Match") == "" {
+					sendReq.Header.Set("If-None-Match", etag)
+				}
+				if lastModified != "" && sendReq.Header.Get("If-Modified-Since") == "" {
+					sendReq.Header.Set("If-Modified-Since", lastModified)
+				}
+			}
+		}
+		res, err := next.RoundTrip(sendReq)
+		if err != nil {
+			if cached != nil {
+				cached.Body.Close()
+			}
+			return res, err
+		}
+		if cached != nil && res.StatusCode == http.StatusNotModified && revalidating {
+			// revalidated, refresh the stored headers by the 304 response
+			res.Body.Close()
+			for key, values := range res.Header {
+				if key == "Content-Length" || key == "Transfer-Encoding" {
+					continue
+				}
+				cached.Header[key] = values
+			}
+			body, readErr := ioutil.ReadAll(cached.Body)
+			cached.Body.Close()
+			if readErr != nil {
+				return nil, readErr
+			}
+			if isCacheable(req, cached) {
+				cache.store(req, cached, body)
+			}
+			cached.Body = ioutil.NopCloser(bytes.NewReader(body))
+			cached.Header.Set(XFromCache, "1")
+			return cached, nil
+		}
+		if cached != nil {
+			cached.Body.Close()
+		}
+		if !isCacheable(req, res) {
+			if _, ok := parseCacheControl(res.Header)["no-store"]; ok {
+				cache.Storage.Delete(cacheKey(req))
+			}
+			return res, nil
+		}
+		resCopy := *res
+		res.Body = &cachingBody{
+			ReadCloser: res.Body,
+			limit:      cache.maxEntrySize(),
+			store: func(body []byte) {
+				cache.store(req, &resCopy, body)
+			},
+		}
+		return res, nil
+	})
+}
+
+// NewMemoryCacheStorage create an in-memory storage which evicts the least recently used entry
+// when there are more than maxEntries entries
+func NewMemoryCacheStorage(maxEntries int) CacheStorage {
+	return &memoryCacheStorage{
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+	}
+}
+
+type memoryCacheStorage struct {
+	mu         sync.Mutex
+	maxEntries int
+	ll         *list.List
+	items      map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	key   string
+	value []byte
+}
+
+func (s *memoryCacheStorage) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[key]; ok {
+		s.ll.MoveToFront(e)
+		return e.Value.(*memoryCacheEntry).value, true
+	}
+	return nil, false
+}
+
+func (s *memoryCacheStorage) Set(key string, value []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[key]; ok {
+		s.ll.MoveToFront(e)
+		e.Value.(*memoryCacheEntry).value = value
+		return
+	}
+	s.items[key] = s.ll.PushFront(&memoryCacheEntry{key: key, value: value})
+	for s.maxEntries > 0 && s.ll.Len() > s.maxEntries {
+		e := s.ll.Back()
+		s.ll.Remove(e)
+		delete(s.items, e.Value.(*memoryCacheEntry).key)
+	}
+}
+
+func (s *memoryCacheStorage) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.items[key]; ok {
+		s.ll.Remove(e)
+		delete(s.items, key)
+	}
+}
+
+// NewDiskCacheStorage create a storage which keeps each entry in a file of dir
+func NewDiskCacheStorage(dir string) (CacheStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &diskCacheStorage{dir: dir}, nil
+}
+
+type diskCacheStorage struct {
+	dir string
+}
+
+func (s *diskCacheStorage) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+func (s *diskCacheStorage) Get(key string) ([]byte, bool) {
+	data, err := ioutil.ReadFile(s.path(key))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+func (s *diskCacheStorage) Set(key string, value []byte) {
+	tmp, err := ioutil.TempFile(s.dir, ".*.tmp")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(value)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	if err := os.Rename(tmp.Name(), s.path(key)); err != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+func (s *diskCacheStorage) Delete(key string) {
+	os.Remove(s.path(key))
+}
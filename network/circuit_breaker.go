@@ -0,0 +1,270 @@
+package network
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned without sending the request when the circuit of the host is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitState is the state of the circuit of a host
+type CircuitState int
+
+const (
+	// CircuitClosed let every request through and count the failures
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fail every request fast until the cool-down ends
+	CircuitOpen
+	// CircuitHalfOpen let a few trial requests through to decide whether to close the circuit
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "circuit-state(" + strconv.Itoa(int(s)) + ")"
+}
+
+// CircuitBreaker keep a circuit per host, the circuit opens when the failure ratio of requests
+// in Window reaches FailureRatio, and is half-open after CoolDown to try the host again
+type CircuitBreaker struct {
+	// FailureRatio opens the circuit when failures / requests reaches it, default is 0.5
+	FailureRatio float64
+	// MinRequests is the minimum requests in Window before FailureRatio is evaluated, default is 10
+	MinRequests int
+	// Window is the interval the counts of a closed circuit are reset, default is 1 minute
+	Window time.Duration
+	// CoolDown is how long the circuit stays open, default is 30 seconds
+	CoolDown time.Duration
+	// HalfOpenRequests is the number of trial requests in half-open state,
+	// the circuit is closed when all of them succeed, default is 1
+	HalfOpenRequests int
+	// IsFailure decide the result of a request is a failure, default is transport error or status code >= 500
+	IsFailure func(res *http.Response, err error) bool
+	// OnStateChange is called when the circuit of host changes state
+	OnStateChange func(host string, from, to CircuitState)
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+type circuit struct {
+	state CircuitState
+	// generation is increased on every state change, results of requests allowed by an old generation are ignored
+	generation  uint64
+	windowStart time.Time
+	openedAt    time.Time
+	requests    int
+	failures    int
+	inflight    int
+	successes   int
+}
+
+// NewCircuitBreaker create a circuit breaker with default settings
+func NewCircuitBreaker() *CircuitBreaker {
+	return &CircuitBreaker{
+		FailureRatio:     0.5,
+		MinRequests:      10,
+		Window:           time.Minute,
+		CoolDown:         30 * time.Second,
+		HalfOpenRequests: 1,
+	}
+}
+
+// State return the current state of the circuit of host
+func (b *CircuitBreaker) State(host string) CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if cc, ok := b.circuits[host]; ok {
+		if cc.state == CircuitOpen && time.Since(cc.openedAt) >= b.coolDown() {
+			return CircuitHalfOpen
+		}
+		return cc.state
+	}
+	return CircuitClosed
+}
+
+// Reset close the circuits of all hosts
+func (b *CircuitBreaker) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.circuits = nil
+}
+
+func (b *CircuitBreaker) failureRatio() float64 {
+	if b.FailureRatio <= 0 {
+		return 0.5
+	}
+	return b.FailureRatio
+}
+
+func (b *CircuitBreaker) minRequests() int {
+	if b.MinRequests <= 0 {
+		return 10
+	}
+	return b.MinRequests
+}
+
+func (b *CircuitBreaker) window() time.Duration {
+	if b.Window <= 0 {
+		return time.Minute
+	}
+	return b.Window
+}
+
+func (b *CircuitBreaker) coolDown() time.Duration {
+	if b.CoolDown <= 0 {
+		return 30 * time.Second
+	}
+	return b.CoolDown
+}
+
+func (b *CircuitBreaker) halfOpenRequests() int {
+	if b.HalfOpenRequests <= 0 {
+		return 1
+	}
+	return b.HalfOpenRequests
+}
+
+func (b *CircuitBreaker) isFailure(res *http.Response, err error) bool {
+	if b.IsFailure != nil {
+		return b.IsFailure(res, err)
+	}
+	return err != nil || res.StatusCode >= 500
+}
+
+// allow return the generation of the circuit when the request can be sent
+func (b *CircuitBreaker) allow(host string) (uint64, error) {
+	b.mu.Lock()
+	now := time.Now()
+	if b.circuits == nil {
+		b.circuits = make(map[string]*circuit)
+	}
+	cc, ok := b.circuits[host]
+	if !ok {
+		cc = &circuit{windowStart: now}
+		b.circuits[host] = cc
+	}
+	var changed func()
+	if cc.state == CircuitOpen && now.Sub(cc.openedAt) >= b.coolDown() {
+		changed = b.setState(host, cc, CircuitHalfOpen, now)
+	}
+	var err error
+	switch cc.state {
+	case CircuitOpen:
+		err = ErrCircuitOpen
+	case CircuitHalfOpen:
+		if cc.inflight+cc.successes >= b.halfOpenRequests() {
+			err = ErrCircuitOpen
+		} else {
+			cc.inflight++
+		}
+	}
+	generation := cc.generation
+	b.mu.Unlock()
+	if changed != nil {
+		changed()
+	}
+	return generation, err
+}
+
+func (b *CircuitBreaker) record(host string, generation uint64, failure bool) {
+	b.mu.Lock()
+	now := time.Now()
+	cc, ok := b.circuits[host]
+	if !ok || cc.generation != generation {
+		b.mu.Unlock()
+		return
+	}
+	var changed func()
+	switch cc.state {
+	case CircuitClosed:
+		if now.Sub(cc.windowStart) >= b.window() {
+			cc.windowStart = now
+			cc.requests, cc.failures = 0, 0
+		}
+		cc.requests++
+		if failure {
+			cc.failures++
+		}
+		if cc.requests >= b.minRequests() && float64(cc.failures)/float64(cc.requests) >= b.failureRatio() {
+			changed = b.setState(host, cc, CircuitOpen, now)
+		}
+	case CircuitHalfOpen:
+		cc.inflight--
+		if failure {
+			changed = b.setState(host, cc, CircuitOpen, now)
+		} else {
+			cc.successes++
+			if cc.successes >= b.halfOpenRequests() {
+				changed = b.setState(host, cc, CircuitClosed, now)
+			}
+		}
+	}
+	b.mu.Unlock()
+	if changed != nil {
+		changed()
+	}
+}
+
+// cancel release the trial slot of a request whose result is unknown, e.g. cancelled by the caller
+func (b *CircuitBreaker) cancel(host string, generation uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if cc, ok := b.circuits[host]; ok && cc.generation == generation && cc.state == CircuitHalfOpen {
+		cc.inflight--
+	}
+}
+
+// setState must be called with b.mu held, it returns the callback to be called after b.mu is released
+func (b *CircuitBreaker) setState(host string, cc *circuit, state CircuitState, now time.Time) func() {
+	from := cc.state
+	cc.state = state
+	cc.generation++
+	cc.windowStart = now
+	cc.requests, cc.failures, cc.inflight, cc.successes = 0, 0, 0, 0
+	if state == CircuitOpen {
+		cc.openedAt = now
+	}
+	if b.OnStateChange == nil {
+		return nil
+	}
+	onStateChange := b.OnStateChange
+	return func() {
+		onStateChange(host, from, state)
+	}
+}
+
+func (c *HttpClient) circuitBreakerMiddleware(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		breaker := c.CircuitBreaker
+		if breaker == nil {
+			return next.RoundTrip(req)
+		}
+		host := req.URL.Host
+		generation, err := breaker.allow(host)
+		if err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, err
+		}
+		res, err := next.RoundTrip(req)
+		if err != nil && req.Context().Err() != nil {
+			breaker.cancel(host, generation)
+			return res, err
+		}
+		breaker.record(host, generation, breaker.isFailure(res, err))
+		return res, err
+	})
+}
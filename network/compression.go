@@ -0,0 +1,162 @@
+package network
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Compression compress the request bodies of HttpClient
+type Compression struct {
+	// Encoding of request bodies, "gzip" or "deflate"
+	Encoding string
+	// Level is the compression level of compress/flate, 0 means the default level
+	Level int
+	// MinSize keep the bodies smaller than it uncompressed, default is 1024 bytes,
+	// bodies of unknown size are always compressed
+	MinSize int64
+}
+
+// NewCompression create a compression of encoding for bodies of 1024 bytes or larger
+func NewCompression(encoding string) *Compression {
+	return &Compression{Encoding: encoding}
+}
+
+func (c *Compression) minSize() int64 {
+	if c.MinSize == 0 {
+		return 1024
+	}
+	return c.MinSize
+}
+
+func (c *Compression) level() int {
+	if c.Level == 0 {
+		return flate.DefaultCompression
+	}
+	return c.Level
+}
+
+func (c *Compression) validate() error {
+	if c.Encoding != "gzip" && c.Encoding != "deflate" {
+		return fmt.Errorf("unsupported compression encoding %q, must be gzip or deflate", c.Encoding)
+	}
+	if c.Level < flate.HuffmanOnly || c.Level > flate.BestCompression {
+		return fmt.Errorf("invalid compression level %d", c.Level)
+	}
+	return nil
+}
+
+func (c *Compression) newWriter(w io.Writer) (io.WriteCloser, error) {
+	if c.Encoding == "deflate" {
+		return zlib.NewWriterLevel(w, c.level())
+	}
+	return gzip.NewWriterLevel(w, c.level())
+}
+
+// compress stream body through the compressor, body is closed when it is read to the end or the result is closed
+func (c *Compression) compress(body io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.Close()
+		w, err := c.newWriter(pw)
+		if err == nil {
+			_, err = io.Copy(w, body)
+			if closeErr := w.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// decompressBody decode the body of Content-Encoding gzip or deflate when it is first read
+type decompressBody struct {
+	body     io.ReadCloser
+	encoding string
+	reader   io.Reader
+	err      error
+}
+
+func (b *decompressBody) Read(p []byte) (int, error) {
+	if b.reader == nil && b.err == nil {
+		br := bufio.NewReader(b.body)
+		if _, err := br.Peek(1); err == io.EOF {
+			// an empty body is not compressed
+			b.reader = br
+		} else if b.encoding == "gzip" {
+			b.reader, b.err = gzip.NewReader(br)
+		} else if header, _ := br.Peek(2); len(header) == 2 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+			b.reader, b.err = zlib.NewReader(br)
+		} else {
+			// some servers send raw deflate without zlib header
+			b.reader = flate.NewReader(br)
+		}
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.reader.Read(p)
+}
+
+func (b *decompressBody) Close() error {
+	if closer, ok := b.reader.(io.Closer); ok {
+		closer.Close()
+	}
+	return b.body.Close()
+}
+
+// compressionMiddleware compress the request body by Compression, and decompress gzip and deflate responses
+// even if the caller set Accept-Encoding, which stops http.Transport decompressing them
+func (c *HttpClient) compressionMiddleware(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		out := req
+		if req.Header.Get("Accept-Encoding") == "" && req.Header.Get("Range") == "" {
+			out = req.Clone(req.Context())
+			out.Header.Set("Accept-Encoding", "gzip, deflate")
+		}
+		compression := c.Compression
+		if compression != nil && req.Body != nil && req.Body != http.NoBody && req.Header.Get("Content-Encoding") == "" &&
+			(req.ContentLength < 0 || req.ContentLength >= compression.minSize()) {
+			if err := compression.validate(); err != nil {
+				req.Body.Close()
+				return nil, err
+			}
+			if out == req {
+				out = req.Clone(req.Context())
+			}
+			out.Body = compression.compress(req.Body)
+			out.ContentLength = -1
+			out.Header.Del("Content-Length")
+			out.Header.Set("Content-Encoding", compression.Encoding)
+			if req.GetBody != nil {
+				out.GetBody = func() (io.ReadCloser, error) {
+					body, err := req.GetBody()
+					if err != nil {
+						return nil, err
+					}
+					return compression.compress(body), nil
+				}
+			}
+		}
+		res, err := next.RoundTrip(out)
+		if err != nil {
+			return res, err
+		}
+		encoding := strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding")))
+		if (encoding != "gzip" && encoding != "deflate") || req.Method == http.MethodHead {
+			return res, nil
+		}
+		res.Body = &decompressBody{body: res.Body, encoding: encoding}
+		res.Header.Del("Content-Encoding")
+		res.Header.Del("Content-Length")
+		res.ContentLength = -1
+		res.Uncompressed = true
+		return res, nil
+	})
+}
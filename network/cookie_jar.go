@@ -0,0 +1,299 @@
+package network
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// cookieSaveDelay is the time a change of cookies waits before it is saved, the changes in between are saved together
+const cookieSaveDelay = time.Second
+
+// CookieJar is a http.CookieJar which can list and clear its cookies, and persist them to a file
+// so a session survives restarts. Changes are saved in batches, call Close before exiting to save the last ones.
+//
+// The jar has no public suffix list, golang.org/x/net/publicsuffix is not a dependency of this module.
+// A host can therefore set a cookie for a public suffix such as co.uk, which is then sent to every host under it.
+// Only share a jar between hosts which trust each other.
+type CookieJar struct {
+	mu      sync.Mutex
+	jar     *cookiejar.Jar
+	path    string
+	entries map[string]*savedCookie
+	dirty   bool
+	timer   *time.Timer
+}
+
+// savedCookie is a cookie with the url which set it
+type savedCookie struct {
+	URL      string        `json:"url"`
+	Name     string        `json:"name"`
+	Value    string        `json:"value"`
+	Path     string        `json:"path,omitempty"`
+	Domain   string        `json:"domain,omitempty"`
+	Expires  time.Time     `json:"expires,omitempty"`
+	Secure   bool          `json:"secure,omitempty"`
+	HttpOnly bool          `json:"http_only,omitempty"`
+	SameSite http.SameSite `json:"same_site,omitempty"`
+}
+
+func (s *savedCookie) cookie() *http.Cookie {
+	return &http.Cookie{
+		Name:     s.Name,
+		Value:    s.Value,
+		Path:     s.Path,
+		Domain:   s.Domain,
+		Expires:  s.Expires,
+		Secure:   s.Secure,
+		HttpOnly: s.HttpOnly,
+		SameSite: s.SameSite,
+	}
+}
+
+func (s *savedCookie) expired(now time.Time) bool {
+	return !s.Expires.IsZero() && !s.Expires.After(now)
+}
+
+// NewCookieJar create a cookie jar without a public suffix list, cookies are loaded from and saved to path
+// when it is not empty
+func NewCookieJar(path string) (*CookieJar, error) {
+	jar, _ := cookiejar.New(nil)
+	j := &CookieJar{
+		jar:     jar,
+		path:    path,
+		entries: make(map[string]*savedCookie),
+	}
+	if path == "" {
+		return j, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved []*savedCookie
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &saved); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	for _, s := range saved {
+		if s.expired(now) {
+			continue
+		}
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			continue
+		}
+		j.jar.SetCookies(u, []*http.Cookie{s.cookie()})
+		j.entries[cookieKey(u, s.Domain, s.Path, s.Name)] = s
+	}
+	return j, nil
+}
+
+func cookieKey(u *url.URL, domain, path, name string) string {
+	return u.Host + "|" + domain + "|" + path + "|" + name
+}
+
+// SetCookies implements http.CookieJar, the cookies are saved to the file of the jar within cookieSaveDelay,
+// a failed save is retried by the next change, Save or Close
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.jar.SetCookies(u, cookies)
+	now := time.Now()
+	origin := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}
+	for _, cookie := range cookies {
+		key := cookieKey(u, cookie.Domain, cookie.Path, cookie.Name)
+		s := &savedCookie{
+			URL:      origin.String(),
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Path:     cookie.Path,
+			Domain:   cookie.Domain,
+			Expires:  cookie.Expires,
+			Secure:   cookie.Secure,
+			HttpOnly: cookie.HttpOnly,
+			SameSite: cookie.SameSite,
+		}
+		if cookie.MaxAge > 0 {
+			s.Expires = now.Add(time.Duration(cookie.MaxAge) * time.Second)
+		}
+		if cookie.MaxAge < 0 || s.expired(now) {
+			delete(j.entries, key)
+			continue
+		}
+		j.entries[key] = s
+	}
+	j.dirty = true
+	if j.path != "" && j.timer == nil {
+		j.timer = time.AfterFunc(cookieSaveDelay, j.flush)
+	}
+}
+
+// flush save the changes of cookies scheduled by SetCookies
+func (j *CookieJar) flush() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.timer = nil
+	if j.dirty {
+		j.save()
+	}
+}
+
+// Cookies implements http.CookieJar, it returns the cookies to send in a request for u
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.jar.Cookies(u)
+}
+
+// All return every cookie in the jar which is not expired, include the domain, path and expiry
+func (j *CookieJar) All() []*http.Cookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	var keys []string
+	for key, s := range j.entries {
+		if !s.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	cookies := make([]*http.Cookie, 0, len(keys))
+	for _, key := range keys {
+		cookies = append(cookies, j.entries[key].cookie())
+	}
+	return cookies
+}
+
+// Clear remove every cookie in the jar and its file
+func (j *CookieJar) Clear() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.jar, _ = cookiejar.New(nil)
+	j.entries = make(map[string]*savedCookie)
+	return j.save()
+}
+
+// Save write the cookies to the file of the jar now, instead of waiting for the batch of changes
+func (j *CookieJar) Save() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.save()
+}
+
+// Close save the changes of cookies which are not saved yet, the jar can still be used after it is closed
+func (j *CookieJar) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.timer != nil {
+		j.timer.Stop()
+		j.timer = nil
+	}
+	if !j.dirty {
+		return nil
+	}
+	return j.save()
+}
+
+// save write the cookies to the file of the jar, the jar stays dirty when it fails
+func (j *CookieJar) save() error {
+	if j.path == "" {
+		j.dirty = false
+		return nil
+	}
+	now := time.Now()
+	var keys []string
+	for key, s := range j.entries {
+		if !s.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	saved := make([]*savedCookie, 0, len(keys))
+	for _, key := range keys {
+		saved = append(saved, j.entries[key])
+	}
+	data, err := json.MarshalIndent(saved, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(j.path), "."+filepath.Base(j.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), j.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	j.dirty = false
+	return nil
+}
+
+// SetCookieJar set the cookie jar shared by every request of the client, a nil jar disables cookies
+func (c *HttpClient) SetCookieJar(jar *CookieJar) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cookieJar = jar
+	client := *c.client
+	client.Jar = c.httpCookieJar()
+	c.client = &client
+}
+
+// CookieJar return the cookie jar of the client, it is nil when cookies are disabled
+func (c *HttpClient) CookieJar() *CookieJar {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cookieJar
+}
+
+// Cookies return the cookies of the client to send in a request for rawURL
+func (c *HttpClient) Cookies(rawURL string) ([]*http.Cookie, error) {
+	jar := c.CookieJar()
+	if jar == nil {
+		return nil, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return jar.Cookies(u), nil
+}
+
+// ClearCookies remove every cookie of the client
+func (c *HttpClient) ClearCookies() error {
+	jar := c.CookieJar()
+	if jar == nil {
+		return nil
+	}
+	return jar.Clear()
+}
+
+// httpCookieJar must be called with c.mu held, it keeps http.Client.Jar a nil interface when there is no jar
+func (c *HttpClient) httpCookieJar() http.CookieJar {
+	if c.cookieJar == nil {
+		return nil
+	}
+	return c.cookieJar
+}
@@ -0,0 +1,466 @@
+package network
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DownloadOptions control how HttpClient download a file
+type DownloadOptions struct {
+	// ExpectedSHA256 is the hex encoded sha256 checksum of the file, empty means not verified
+	ExpectedSHA256 string
+	// MaxResumes is how many times an interrupted transfer is resumed by Range request
+	MaxResumes int
+	// Progress is called after each write with downloaded bytes and total bytes, total is -1 when unknown
+	Progress func(done, total int64)
+	// Segments is the number of byte ranges downloaded concurrently, less than 2 means a single stream.
+	// It falls back to a single stream when the server does not support Range request.
+	Segments int
+	// MinSegmentSize is the minimum bytes of a segment, a small file is downloaded with fewer segments
+	MinSegmentSize int64
+}
+
+// DefaultDownloadOptions resume an interrupted transfer at most 3 times
+func DefaultDownloadOptions() *DownloadOptions {
+	return &DownloadOptions{MaxResumes: 3, MinSegmentSize: 1 << 20}
+}
+
+// DownloadFileWithOptions download file to a temporary file in the same directory of filePath,
+// and rename it to filePath only when the whole file is received and verified.
+// An interrupted transfer is resumed by Range request and validated by ETag or Last-Modified.
+func (c *HttpClient) DownloadFileWithOptions(ctx context.Context, url, filePath string, header map[string]string, opts *DownloadOptions) error {
+	if opts == nil {
+		opts = DefaultDownloadOptions()
+	}
+	out, err := createTempFile(filepath.Dir(filePath), "."+filepath.Base(filePath)+".", ".download")
+	if err != nil {
+		return newFileError("create", filePath, err)
+	}
+	client := c.getClient()
+	defer c.closeIdleConnections(client)
+	d := &download{
+		c:      c,
+		client: client,
+		ctx:    ctx,
+		url:    url,
+		header: header,
+		opts:   opts,
+		out:    out,
+		hash:   sha256.New(),
+		total:  -1,
+	}
+	segmented := false
+	if opts.Segments > 1 {
+		segmented, err = d.runSegmented()
+	}
+	if !segmented && err == nil {
+		err = d.run()
+	}
+	if err == nil {
+		err = newFileError("write", out.Name(), out.Sync())
+	}
+	if closeErr := out.Close(); err == nil {
+		err = newFileError("write", out.Name(), closeErr)
+	}
+	if err == nil {
+		err = d.verify()
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return newFileError("rename", filePath, os.Rename(out.Name(), filePath))
+}
+
+// createTempFile create a new file like ioutil.TempFile, but with mode 0666 before umask as os.Create does,
+// so the downloaded file keeps the usual mode after it is renamed
+func createTempFile(dir, prefix, suffix string) (*os.File, error) {
+	for try := 0; ; try++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10)+suffix)
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && try < 10000 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// errRangeIgnored is returned by a segment whose Range request is answered with the whole file,
+// the file is then downloaded by a single stream
+var errRangeIgnored = errors.New("server ignored Range request of segment")
+
+type download struct {
+	c      *HttpClient
+	client *http.Client
+	ctx    context.Context
+	url    string
+	header map[string]string
+	opts   *DownloadOptions
+	out    *os.File
+	hash   hash.Hash
+	// done is updated atomically when segments are downloaded concurrently
+	done  int64
+	total int64
+	// progressMu keep Progress called serially by segments
+	progressMu sync.Mutex
+	// validators of the first response, used by If-Range when resuming
+	etag         string
+	lastModified string
+}
+
+// interruptedError is a failure of reading response body, the transfer can be resumed
+type interruptedError struct {
+	err error
+}
+
+func (e *interruptedError) Error() string {
+	return "download interrupted: " + e.err.Error()
+}
+
+func (e *interruptedError) Unwrap() error {
+	return e.err
+}
+
+func (e *interruptedError) Is(target error) bool {
+	return target == ErrTransport
+}
+
+func (d *download) run() error {
+	for resumes := 0; ; resumes++ {
+		err := d.fetch()
+		var interrupted *interruptedError
+		if err == nil || !errors.As(err, &interrupted) || d.ctx.Err() != nil || resumes >= d.opts.MaxResumes {
+			return err
+		}
+	}
+}
+
+func (d *download) fetch() error {
+	req, err := http.NewRequestWithContext(d.ctx, "GET", d.url, nil)
+	if err != nil {
+		return newRequestError("GET", d.url, err)
+	}
+	// keep the byte offsets of Range request same as the first response
+	req.Header.Set("Accept-Encoding", "identity")
+	setHeader(req, d.header)
+	if d.done > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.done))
+		d.setIfRange(req)
+	}
+	res, err := d.c.do(d.client, req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode >= 400:
+		return newStatusError(res)
+	case d.done > 0 && res.StatusCode == http.StatusPartialContent:
+		if err := d.checkPartial(res); err != nil {
+			return err
+		}
+	default:
+		// first response, or the server ignored Range because the file changed
+		if err := d.restart(res); err != nil {
+			return err
+		}
+	}
+	return d.receive(res.Body)
+}
+
+func (d *download) restart(res *http.Response) error {
+	if d.done > 0 {
+		if _, err := d.out.Seek(0, io.SeekStart); err != nil {
+			return newFileError("write", d.out.Name(), err)
+		}
+		if err := d.out.Truncate(0); err != nil {
+			return newFileError("write", d.out.Name(), err)
+		}
+		d.hash.Reset()
+		d.done = 0
+	}
+	d.total = res.ContentLength
+	d.etag = res.Header.Get("ETag")
+	d.lastModified = res.Header.Get("Last-Modified")
+	return nil
+}
+
+func (d *download) checkPartial(res *http.Response) error {
+	start, total, err := parseContentRange(res.Header.Get("Content-Range"))
+	if err != nil {
+		return err
+	}
+	if start != d.done {
+		return fmt.Errorf("resume download at byte %d but server returns from byte %d", d.done, start)
+	}
+	if etag := res.Header.Get("ETag"); d.etag != "" && etag != "" && etag != d.etag {
+		return fmt.Errorf("file changed while downloading, etag %s is not %s", etag, d.etag)
+	}
+	if total >= 0 {
+		if d.total >= 0 && total != d.total {
+			return fmt.Errorf("file changed while downloading, size %d is not %d", total, d.total)
+		}
+		d.total = total
+	}
+	return nil
+}
+
+func (d *download) receive(body io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if _, err := d.out.Write(buf[:n]); err != nil {
+				return newFileError("write", d.out.Name(), err)
+			}
+			d.hash.Write(buf[:n])
+			d.addProgress(int64(n))
+		}
+		if readErr == io.EOF {
+			if d.total >= 0 && d.done < d.total {
+				return &interruptedError{io.ErrUnexpectedEOF}
+			}
+			return nil
+		}
+		if readErr != nil {
+			return &interruptedError{readErr}
+		}
+	}
+}
+
+func (d *download) verify() error {
+	if d.total >= 0 && d.done != d.total {
+		return fmt.Errorf("downloaded %d bytes but Content-Length is %d", d.done, d.total)
+	}
+	if d.opts.ExpectedSHA256 != "" {
+		sum := hex.EncodeToString(d.hash.Sum(nil))
+		if !strings.EqualFold(sum, d.opts.ExpectedSHA256) {
+			return fmt.Errorf("sha256 checksum mismatch, expected %s but got %s", d.opts.ExpectedSHA256, sum)
+		}
+	}
+	return nil
+}
+
+// parseContentRange parse "bytes start-end/total", total is -1 when it is "*"
+func parseContentRange(value string) (int64, int64, error) {
+	invalid := fmt.Errorf("invalid Content-Range: %q", value)
+	if !strings.HasPrefix(value, "bytes ") {
+		return 0, 0, invalid
+	}
+	value = strings.TrimPrefix(value, "bytes ")
+	slash := strings.Index(value, "/")
+	dash := strings.Index(value, "-")
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, invalid
+	}
+	start, err := strconv.ParseInt(value[:dash], 10, 64)
+	if err != nil {
+		return 0, 0, invalid
+	}
+	total := int64(-1)
+	if value[slash+1:] != "*" {
+		total, err = strconv.ParseInt(value[slash+1:], 10, 64)
+		if err != nil {
+			return 0, 0, invalid
+		}
+	}
+	return start, total, nil
+}
+
+// runSegmented probe the server by a Range request, and download the file by concurrent byte ranges
+// if it is supported. It returns false when the file should be downloaded by a single stream.
+func (d *download) runSegmented() (bool, error) {
+	total, err := d.probeRange()
+	if err != nil || total <= 0 {
+		return false, err
+	}
+	segments := int64(d.opts.Segments)
+	if d.opts.MinSegmentSize > 0 && total/d.opts.MinSegmentSize < segments {
+		segments = total / d.opts.MinSegmentSize
+	}
+	if segments < 2 {
+		return false, nil
+	}
+	if err := d.out.Truncate(total); err != nil {
+		return true, newFileError("write", d.out.Name(), err)
+	}
+	d.total = total
+	ctx, cancel := context.WithCancel(d.ctx)
+	defer cancel()
+	segmentSize := total / segments
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i := int64(0); i < segments; i++ {
+		start := i * segmentSize
+		end := start + segmentSize - 1
+		if i == segments-1 {
+			end = total - 1
+		}
+		wg.Add(1)
+		go func(start, end int64) {
+			defer wg.Done()
+			if err := d.fetchSegment(ctx, start, end); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	if firstErr == errRangeIgnored {
+		d.c.getLogger().Warn("server ignored Range request of segment, download by a single stream", "url", d.url)
+		return false, d.reset()
+	}
+	if firstErr != nil {
+		return true, firstErr
+	}
+	// segments are written out of order, hash the whole file at last
+	if _, err := d.out.Seek(0, io.SeekStart); err != nil {
+		return true, newFileError("read", d.out.Name(), err)
+	}
+	if _, err := io.Copy(d.hash, d.out); err != nil {
+		return true, newFileError("read", d.out.Name(), err)
+	}
+	return true, nil
+}
+
+// reset discard the segments written to the file, so it can be downloaded again from the start
+func (d *download) reset() error {
+	if err := d.out.Truncate(0); err != nil {
+		return newFileError("write", d.out.Name(), err)
+	}
+	if _, err := d.out.Seek(0, io.SeekStart); err != nil {
+		return newFileError("write", d.out.Name(), err)
+	}
+	d.done = 0
+	d.total = -1
+	return nil
+}
+
+// probeRange request the first byte of the file, and return the file size if the server supports Range request
+func (d *download) probeRange() (int64, error) {
+	req, err := http.NewRequestWithContext(d.ctx, "GET", d.url, nil)
+	if err != nil {
+		return 0, newRequestError("GET", d.url, err)
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	setHeader(req, d.header)
+	req.Header.Set("Range", "bytes=0-0")
+	res, err := d.c.do(d.client, req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 400 && res.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		return 0, newStatusError(res)
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096))
+	if res.StatusCode != http.StatusPartialContent {
+		return 0, nil
+	}
+	_, total, err := parseContentRange(res.Header.Get("Content-Range"))
+	if err != nil {
+		return 0, nil
+	}
+	d.etag = res.Header.Get("ETag")
+	d.lastModified = res.Header.Get("Last-Modified")
+	return total, nil
+}
+
+func (d *download) fetchSegment(ctx context.Context, start, end int64) error {
+	offset := start
+	for resumes := 0; ; resumes++ {
+		err := d.fetchRange(ctx, &offset, end)
+		var interrupted *interruptedError
+		if err == nil || !errors.As(err, &interrupted) || ctx.Err() != nil || resumes >= d.opts.MaxResumes {
+			return err
+		}
+	}
+}
+
+func (d *download) fetchRange(ctx context.Context, offset *int64, end int64) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", d.url, nil)
+	if err != nil {
+		return newRequestError("GET", d.url, err)
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	setHeader(req, d.header)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", *offset, end))
+	d.setIfRange(req)
+	res, err := d.c.do(d.client, req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		// the server does not support Range for every request, or If-Range found the file changed
+		return errRangeIgnored
+	}
+	if res.StatusCode != http.StatusPartialContent {
+		return newStatusError(res)
+	}
+	start, total, err := parseContentRange(res.Header.Get("Content-Range"))
+	if err != nil {
+		return err
+	}
+	if start != *offset || (total >= 0 && total != d.total) {
+		return fmt.Errorf("file changed while downloading, Content-Range is %s", res.Header.Get("Content-Range"))
+	}
+	buf := make([]byte, 32*1024)
+	for *offset <= end {
+		n, readErr := res.Body.Read(buf)
+		if int64(n) > end-*offset+1 {
+			n = int(end - *offset + 1)
+		}
+		if n > 0 {
+			if _, err := d.out.WriteAt(buf[:n], *offset); err != nil {
+				return newFileError("write", d.out.Name(), err)
+			}
+			*offset += int64(n)
+			d.addProgress(int64(n))
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return &interruptedError{readErr}
+		}
+	}
+	if *offset <= end {
+		return &interruptedError{io.ErrUnexpectedEOF}
+	}
+	return nil
+}
+
+func (d *download) setIfRange(req *http.Request) {
+	if d.etag != "" && !strings.HasPrefix(d.etag, "W/") {
+		req.Header.Set("If-Range", d.etag)
+	} else if d.lastModified != "" {
+		req.Header.Set("If-Range", d.lastModified)
+	}
+}
+
+func (d *download) addProgress(n int64) {
+	done := atomic.AddInt64(&d.done, n)
+	if d.opts.Progress != nil {
+		d.progressMu.Lock()
+		d.opts.Progress(done, d.total)
+		d.progressMu.Unlock()
+	}
+}
@@ -0,0 +1,282 @@
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// The kinds of errors returned by HttpClient, use errors.Is to check the kind of an error,
+// and errors.As with the error types below to get the details.
+// Methods which return a status code return 0 with these errors when no response is received.
+var (
+	// ErrRequest is the kind of RequestError
+	ErrRequest = errors.New("invalid request")
+	// ErrTransport is the kind of TransportError
+	ErrTransport = errors.New("transport error")
+	// ErrTimeout is the kind of TransportError caused by a timeout or an exceeded deadline
+	ErrTimeout = errors.New("request timeout")
+	// ErrTLS is the kind of TransportError caused by the TLS handshake or certificate verification
+	ErrTLS = errors.New("tls error")
+	// ErrMiddleware is the kind of MiddlewareError
+	ErrMiddleware = errors.New("middleware error")
+	// ErrStatus is the kind of StatusError
+	ErrStatus = errors.New("unexpected status code")
+	// ErrDecode is the kind of DecodeError
+	ErrDecode = errors.New("decode response body error")
+	// ErrFileIO is the kind of FileError
+	ErrFileIO = errors.New("file i/o error")
+	// ErrResponseTooLarge is the kind of ResponseTooLargeError
+	ErrResponseTooLarge = errors.New("response body too large")
+)
+
+// RequestError is returned when the request can not be built, e.g. an invalid url or a body which can not be encoded
+type RequestError struct {
+	Method string
+	URL    string
+	Err    error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("build request %s %s error: %v", e.Method, e.URL, e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+func (e *RequestError) Is(target error) bool {
+	return target == ErrRequest
+}
+
+// TransportError is returned when the request is sent but no response is received,
+// e.g. a DNS or connection failure, a timeout, a TLS failure or a canceled context
+type TransportError struct {
+	Method string
+	URL    string
+	Err    error
+}
+
+func (e *TransportError) Error() string {
+	if _, ok := e.Err.(*url.Error); ok {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s %q: %v", e.Method, e.URL, e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TransportError) Is(target error) bool {
+	switch target {
+	case ErrTransport:
+		return true
+	case ErrTimeout:
+		return e.Timeout()
+	case ErrTLS:
+		return e.TLS()
+	}
+	return false
+}
+
+// Timeout report whether the error is caused by a timeout or an exceeded deadline
+func (e *TransportError) Timeout() bool {
+	if errors.Is(e.Err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) && netErr.Timeout()
+}
+
+// TLS report whether the error is caused by the TLS handshake or certificate verification
+func (e *TransportError) TLS() bool {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		invalidCert      x509.CertificateInvalidError
+		hostname         x509.HostnameError
+		recordHeader     tls.RecordHeaderError
+	)
+	if errors.Is(e.Err, ErrCertificatePinMismatch) || errors.As(e.Err, &unknownAuthority) ||
+		errors.As(e.Err, &invalidCert) || errors.As(e.Err, &hostname) || errors.As(e.Err, &recordHeader) {
+		return true
+	}
+	// alerts of crypto/tls are not exported, they are sent and received as the error of a net.OpError
+	var opErr *net.OpError
+	if errors.As(e.Err, &opErr) && (opErr.Op == "local error" || opErr.Op == "remote error") && opErr.Err != nil {
+		return strings.HasPrefix(opErr.Err.Error(), "tls: ")
+	}
+	return false
+}
+
+// MiddlewareError is returned when a middleware fails the request and the network does not, e.g. an open
+// circuit, an OAuth2 token error, an unmatched recorded interaction or an error of the signer.
+// Use errors.Is or errors.As to get the error of the middleware.
+type MiddlewareError struct {
+	Method string
+	URL    string
+	Err    error
+}
+
+func (e *MiddlewareError) Error() string {
+	if _, ok := e.Err.(*url.Error); ok {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s %q: %v", e.Method, e.URL, e.Err)
+}
+
+func (e *MiddlewareError) Unwrap() error {
+	return e.Err
+}
+
+func (e *MiddlewareError) Is(target error) bool {
+	return target == ErrMiddleware
+}
+
+// StatusError is returned when the status code of the response is not expected. Only the methods without
+// a status code in their results return it, e.g. DownloadFile, the others return the status code and the body
+// of every response without error. Body is the beginning of the response body.
+type StatusError struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Response   *http.Response
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status code is %d", e.StatusCode)
+}
+
+func (e *StatusError) Is(target error) bool {
+	return target == ErrStatus
+}
+
+// ResponseTooLargeError is returned when the response body is larger than the max response size,
+// the rest of the body is not read
+type ResponseTooLargeError struct {
+	StatusCode int
+	Header     http.Header
+	// Limit is the max response size in bytes
+	Limit int64
+}
+
+func (e *ResponseTooLargeError) Error() string {
+	return fmt.Sprintf("response body is larger than %d bytes (status code %d)", e.Limit, e.StatusCode)
+}
+
+func (e *ResponseTooLargeError) Is(target error) bool {
+	return target == ErrResponseTooLarge
+}
+
+// FileError is returned when a local file can not be read or written
+type FileError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s file %s error: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+func (e *FileError) Is(target error) bool {
+	return target == ErrFileIO
+}
+
+func newRequestError(method, url string, err error) error {
+	var requestErr *RequestError
+	if errors.As(err, &requestErr) {
+		return err
+	}
+	return &RequestError{Method: method, URL: url, Err: err}
+}
+
+// newTransportError wrap the error of http.Client.Do
+func newTransportError(req *http.Request, err error) error {
+	var transportErr *TransportError
+	if errors.As(err, &transportErr) {
+		return err
+	}
+	return &TransportError{Method: req.Method, URL: req.URL.String(), Err: err}
+}
+
+// sentKey carry the attempt record of a request in its context
+type sentKey struct{}
+
+// sent record the last error returned by the base transport for a request, so the errors of the network
+// can be told from the errors of the middlewares, and the host the caller sent the request to
+type sent struct {
+	host string
+	mu   sync.Mutex
+	err  error
+}
+
+func withSent(req *http.Request) (*http.Request, *sent) {
+	s := &sent{host: req.URL.Host}
+	return req.WithContext(context.WithValue(req.Context(), sentKey{}, s)), s
+}
+
+// record is called with the result of every round trip of the base transport
+func (s *sent) record(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// byNetwork report whether err comes from the network, a timeout or a canceled context
+func (s *sent) byNetwork(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && urlErr.Timeout() {
+		// http.Client.Timeout replaces the error of the transport
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err != nil && errors.Is(err, s.err)
+}
+
+// newSendError wrap the error of http.Client.Do as TransportError or MiddlewareError
+func newSendError(req *http.Request, s *sent, err error) error {
+	if s.byNetwork(err) {
+		return newTransportError(req, err)
+	}
+	var middlewareErr *MiddlewareError
+	if errors.As(err, &middlewareErr) {
+		return err
+	}
+	return &MiddlewareError{Method: req.Method, URL: req.URL.String(), Err: err}
+}
+
+// newStatusError keep the first bytes of the response body, the body is closed
+func newStatusError(res *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+	res.Body.Close()
+	return &StatusError{StatusCode: res.StatusCode, Header: res.Header, Body: body, Response: res}
+}
+
+func newFileError(op, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var fileErr *FileError
+	if errors.As(err, &fileErr) {
+		return err
+	}
+	return &FileError{Op: op, Path: path, Err: err}
+}
@@ -2,56 +2,98 @@ package network
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
-	"mime/multipart"
 	"net/http"
-	"os"
-	"path/filepath"
+	"sync"
 	"time"
+
+	"github.com/NovanHsiu/goutil/logger"
 )
 
 type HttpClient struct {
-	TimeoutSeconds             int
+	TimeoutSeconds int
+	// InsecureSkipVerify skip verifying the certificate of the server, it is only for testing,
+	// a warning is logged on the first TLS handshake of the client
 	InsecureSkipVerify         bool
 	EnabledSingledResuedClient bool
-	client                     *http.Client
+	// RetryPolicy is used by every request of this client, nil means never retry
+	RetryPolicy *RetryPolicy
+	// Logger of this client, nil means using the logger set by SetLogger
+	Logger logger.Logger
+	// SlowRequestThreshold log the request whose response time is longer than it, 0 means never
+	SlowRequestThreshold time.Duration
+	// CircuitBreaker fail requests fast when their host keeps failing, nil means disabled
+	CircuitBreaker *CircuitBreaker
+	// RateLimiter limit the rate and concurrency of requests per host or url prefix, nil means no limit
+	RateLimiter *RateLimiter
+	// Cache serve GET requests from stored responses when they are fresh, nil means disabled
+	Cache *Cache
+	// TokenSource attach its token to requests without Authorization header, nil means disabled
+	TokenSource TokenSource
+	// Signer sign every request right before it is sent, nil means disabled
+	Signer Signer
+	// WSSecurity add its header to every SOAP envelope sent by the client, nil means disabled
+	WSSecurity *WSSecurity
+	// Recorder record the requests to a fixture or replay the responses from it, nil means disabled
+	Recorder *Recorder
+	// Compression compress request bodies, nil means they are sent as is.
+	// gzip and deflate responses are always decompressed, even if Accept-Encoding is set in header.
+	Compression *Compression
+	// MaxResponseSize limit the bytes of response bodies read into memory, 0 means no limit,
+	// use WithMaxResponseSize to override it per request
+	MaxResponseSize int64
+	client          *http.Client
+	mu              sync.RWMutex
+	middlewares     []Middleware
+	cookieJar       *CookieJar
+	proxyConfig     *ProxyConfig
+	tlsConfig       *tls.Config
+	// insecureOnce warn about InsecureSkipVerify once
+	insecureOnce sync.Once
 }
 
 func NewHttpClient(timeoutSeconds int, insecureSkipVerify, enabledSingledResuedClient bool) *HttpClient {
-	httpClient := HttpClient{
+	httpClient := &HttpClient{
 		TimeoutSeconds:             timeoutSeconds,
 		InsecureSkipVerify:         insecureSkipVerify,
 		EnabledSingledResuedClient: enabledSingledResuedClient,
+		SlowRequestThreshold:       2 * time.Second,
 	}
-	httpClient.client = &http.Client{
-		Timeout: time.Duration(time.Duration(timeoutSeconds) * time.Second),
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: insecureSkipVerify},
-		},
-	}
-	return &httpClient
+	httpClient.middlewares = []Middleware{httpClient.LoggingMiddleware(), httpClient.TimingMiddleware()}
+	httpClient.client = httpClient.newClient()
+	return httpClient
 }
 
+// NewDefaultHttpClient create a client which verifies certificates and reuses connections, with 30 seconds timeout
 func NewDefaultHttpClient() *HttpClient {
-	return NewHttpClient(30, true, true)
+	return NewHttpClient(30, false, true)
+}
+
+// newClient must be called with c.mu held or before the client is shared
+func (c *HttpClient) newClient() *http.Client {
+	return &http.Client{
+		Timeout: time.Duration(time.Duration(c.TimeoutSeconds) * time.Second),
+		Transport: &middlewareTransport{
+			c: c,
+			base: &http.Transport{
+				Proxy:           c.proxy,
+				TLSClientConfig: c.clientTLSConfig(),
+			},
+		},
+		Jar: c.httpCookieJar(),
+	}
 }
 
 func (c *HttpClient) getClient() *http.Client {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	if c.EnabledSingledResuedClient {
 		return c.client
 	}
-	client := &http.Client{
-		Timeout: time.Duration(time.Duration(c.TimeoutSeconds) * time.Second),
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify},
-		},
-	}
-	return client
+	return c.newClient()
 }
 
 func (c *HttpClient) closeIdleConnections(client *http.Client) {
@@ -61,26 +103,33 @@ func (c *HttpClient) closeIdleConnections(client *http.Client) {
 }
 
 func (c *HttpClient) Close() {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	c.client.CloseIdleConnections()
 }
 
-func extractBody(res *http.Response) (int, map[string]interface{}, error) {
-	body, _ := ioutil.ReadAll(res.Body)
-	if len(body) >= 3 {
-		// remove bom
-		if body[0] == 239 && body[1] == 187 && body[2] == 191 {
-			body = body[3:]
-		}
+func (c *HttpClient) extractBody(res *http.Response) (int, map[string]interface{}, error) {
+	body, err := c.readBody(res)
+	if err != nil {
+		return res.StatusCode, nil, err
 	}
+	body = trimBOM(body)
 	jsonMap := make(map[string]interface{})
-	err := json.Unmarshal(body, &jsonMap)
-	if err != nil {
+	if err := json.Unmarshal(body, &jsonMap); err != nil {
 		jsonMap["data"] = body
-		return res.StatusCode, jsonMap, err
+		return res.StatusCode, jsonMap, &DecodeError{StatusCode: res.StatusCode, Body: body, Err: err}
 	}
 	return res.StatusCode, jsonMap, nil
 }
 
+// trimBOM remove utf-8 byte order mark
+func trimBOM(body []byte) []byte {
+	if len(body) >= 3 && body[0] == 239 && body[1] == 187 && body[2] == 191 {
+		return body[3:]
+	}
+	return body
+}
+
 func setHeader(req *http.Request, header map[string]string) {
 	for key := range header {
 		req.Header.Set(key, header[key])
@@ -88,26 +137,28 @@ func setHeader(req *http.Request, header map[string]string) {
 }
 
 func (c *HttpClient) SendBodyRequest(method, url, jsonStr string, header map[string]string) (int, map[string]interface{}, error) {
-	pt := time.Now()
+	return c.SendBodyRequestWithContext(context.Background(), method, url, jsonStr, header)
+}
+
+// SendBodyRequestWithContext send json body request, the request is aborted when ctx is done
+func (c *HttpClient) SendBodyRequestWithContext(ctx context.Context, method, url, jsonStr string, header map[string]string) (int, map[string]interface{}, error) {
 	jsonBytes := []byte(jsonStr)
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(jsonBytes))
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(jsonBytes))
 	if err != nil {
-		log.Println("SendBodyRequest http client new request error:", err)
-		return 500, nil, err
+		c.getLogger().Error("SendBodyRequest http client new request error", "url", url, "error", err)
+		return 0, nil, newRequestError(method, url, err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Connection", "application/json")
 	setHeader(req, header)
 	client := c.getClient()
-	res, err := client.Do(req)
+	res, err := c.do(client, req)
 	defer c.closeIdleConnections(client)
 	if err != nil {
-		log.Println("SendBodyRequest http client do error:", err)
-		return 500, nil, err
+		return 0, nil, err
 	}
 	defer res.Body.Close()
-	showRespTimeLog(url, pt)
-	return extractBody(res)
+	return c.extractBody(res)
 }
 
 type SendFile struct {
@@ -116,63 +167,30 @@ type SendFile struct {
 }
 
 func (c *HttpClient) SendFormDataWithFilesRequest(method, url string, params map[string]string, sendFiles []SendFile, header map[string]string) (int, map[string]interface{}, error) {
-	pt := time.Now()
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	for _, sendFile := range sendFiles {
-		for _, path := range sendFile.Paths {
-			file, err := os.Open(path)
-			if err != nil {
-				log.Println("SendFormDataWithFilesRequest error: ", err)
-				return 500, nil, err
-			}
-			defer file.Close()
-			part, err := writer.CreateFormFile(sendFile.ParamName, filepath.Base(path))
-			if err != nil {
-				log.Println("SendFormDataWithFilesRequest create file error: ", err)
-				return 500, nil, err
-			}
-			_, err = io.Copy(part, file)
-			if err != nil {
-				log.Println("SendFormDataWithFilesRequest file copy error: ", err)
-				return 500, nil, err
-			}
-		}
-	}
-	for key, val := range params {
-		_ = writer.WriteField(key, val)
-	}
-	err := writer.Close()
-	if err != nil {
-		log.Println("SendFormDataWithFilesRequest writer error: ", err)
-		return 500, nil, err
-	}
-	req, err := http.NewRequest(method, url, body)
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	setHeader(req, header)
-	if err != nil {
-		log.Println("SendFormDataWithFilesRequest http new request error: ", err)
-		return 500, nil, err
-	}
-	client := c.getClient()
-	res, err := client.Do(req)
-	defer c.closeIdleConnections(client)
+	return c.SendFormDataWithFilesRequestWithContext(context.Background(), method, url, params, sendFiles, header)
+}
+
+// SendFormDataWithFilesRequestWithContext send multipart form request with files, the upload is aborted when ctx is done
+func (c *HttpClient) SendFormDataWithFilesRequestWithContext(ctx context.Context, method, url string, params map[string]string, sendFiles []SendFile, header map[string]string) (int, map[string]interface{}, error) {
+	parts, err := sendFilesToParts(sendFiles)
 	if err != nil {
-		log.Println("SendFormDataWithFilesRequest http client do error: ", err)
-		return 500, nil, err
+		c.getLogger().Error("SendFormDataWithFilesRequest open file error", "url", url, "error", err)
+		return 0, nil, err
 	}
-	showRespTimeLog(url, pt)
-	return extractBody(res)
+	return c.SendFormDataWithFilePartsRequestWithContext(ctx, method, url, params, parts, header)
 }
 
 func (c *HttpClient) SendSoapRequest(method, url string, payload []byte, header map[string]string) (int, []byte, error) {
-	pt := time.Now()
+	return c.SendSoapRequestWithContext(context.Background(), method, url, payload, header)
+}
 
+// SendSoapRequestWithContext send soap request, the request is aborted when ctx is done
+func (c *HttpClient) SendSoapRequestWithContext(ctx context.Context, method, url string, payload []byte, header map[string]string) (int, []byte, error) {
 	// prepare the request
-	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	req, err := c.newSoapRequest(ctx, method, url, payload)
 	if err != nil {
-		log.Println("SendSoapRequest error creating request object", err)
-		return 500, nil, err
+		c.getLogger().Error("SendSoapRequest error creating request object", "url", url, "error", err)
+		return 0, nil, newRequestError(method, url, err)
 	}
 
 	// set the content type header, as well as the oter required headers
@@ -182,75 +200,55 @@ func (c *HttpClient) SendSoapRequest(method, url string, payload []byte, header
 	client := c.getClient()
 
 	// dispatch the request
-	res, err := client.Do(req)
+	res, err := c.do(client, req)
 	defer c.closeIdleConnections(client)
 	if err != nil {
-		log.Println("SendSoapRequest error http client do", err)
-		return 500, nil, err
+		return 0, nil, err
 	}
-	showRespTimeLog(url, pt)
+	defer res.Body.Close()
 	// read and parse the response body
-	bodyBytes, err := ioutil.ReadAll(res.Body)
-	return res.StatusCode, bodyBytes, err
+	bodyBytes, err := c.readBody(res)
+	if err != nil {
+		return res.StatusCode, bodyBytes, err
+	}
+	return res.StatusCode, bodyBytes, nil
 }
 
 func (c *HttpClient) SendFormDataRequest(method, url string, params map[string]string, header map[string]string) (int, map[string]interface{}, error) {
-	pt := time.Now()
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	for key, val := range params {
-		_ = writer.WriteField(key, val)
-	}
-	err := writer.Close()
+	return c.SendFormDataRequestWithContext(context.Background(), method, url, params, header)
+}
+
+// SendFormDataRequestWithContext send multipart form request, the request is aborted when ctx is done
+func (c *HttpClient) SendFormDataRequestWithContext(ctx context.Context, method, url string, params map[string]string, header map[string]string) (int, map[string]interface{}, error) {
+	mb, err := newMultipartBody(params, nil)
 	if err != nil {
-		log.Println("SendFormDataRequest writer error: ", err)
-		return 500, nil, err
+		c.getLogger().Error("SendFormDataRequest writer error", "url", url, "error", err)
+		return 0, nil, newRequestError(method, url, err)
 	}
-	req, err := http.NewRequest(method, url, body)
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	setHeader(req, header)
+	req, err := mb.newRequest(ctx, method, url)
 	if err != nil {
-		log.Println("SendFormDataRequest http new request error: ", err)
-		return 500, nil, err
+		c.getLogger().Error("SendFormDataRequest http new request error", "url", url, "error", err)
+		return 0, nil, newRequestError(method, url, err)
 	}
+	setHeader(req, header)
 	client := c.getClient()
-	res, err := client.Do(req)
+	res, err := c.do(client, req)
 	defer c.closeIdleConnections(client)
 	if err != nil {
-		log.Println("SendFormDataRequest http client do error: ", err)
-		return 500, nil, err
+		return 0, nil, err
 	}
-	showRespTimeLog(url, pt)
-	return extractBody(res)
+	defer res.Body.Close()
+	return c.extractBody(res)
 }
 
 func (c *HttpClient) SendQueryRequest(method, url string, params map[string]string, header map[string]string) (int, map[string]interface{}, error) {
-	pt := time.Now()
-	query := ""
-	for key, val := range params {
-		if query == "" {
-			query += "?"
-		} else {
-			query += "&"
-		}
-		query += key + "=" + val
-	}
-	client := c.getClient()
-	req, err := http.NewRequest(method, url+query, nil)
-	if err != nil {
-		log.Println("SendQueryRequest http client new request error:", err)
-		return 500, nil, err
-	}
-	setHeader(req, header)
-	res, err := client.Do(req)
-	defer c.closeIdleConnections(client)
-	if err != nil {
-		log.Println("SendQueryRequest http client do error:", err)
-		return 500, nil, err
-	}
-	defer res.Body.Close()
-	showRespTimeLog(url, pt)
-	return extractBody(res)
+	return c.SendQueryRequestWithContext(context.Background(), method, url, params, header)
+}
+
+// SendQueryRequestWithContext send query string request, the request is aborted when ctx is done.
+// params are escaped and merged with the query already in url.
+func (c *HttpClient) SendQueryRequestWithContext(ctx context.Context, method, url string, params map[string]string, header map[string]string) (int, map[string]interface{}, error) {
+	return c.SendQueryValuesRequestWithContext(ctx, method, url, params, header)
 }
 
 func (c *HttpClient) PostBodyRequest(url string, jsonStr string, header map[string]string) (int, map[string]interface{}, error) {
@@ -293,39 +291,17 @@ func (c *HttpClient) CheckHttpServiceConnected(httpUrl string) bool {
 }
 
 func (c *HttpClient) DownloadFile(url string, filepath string, header map[string]string) error {
-	// download the file and check this url is ok
-	client := c.getClient()
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return err
-	}
-	setHeader(req, header)
-	resp, err := client.Do(req)
-	defer c.closeIdleConnections(client)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 400 {
-		return fmt.Errorf("status code is %d", resp.StatusCode)
-	}
-	// Create the file
-	out, err := os.Create(filepath)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-	// Write the body to file
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		return err
-	}
-	return nil
+	return c.DownloadFileWithContext(context.Background(), url, filepath, header)
+}
+
+// DownloadFileWithContext download file to filepath, the transfer is aborted when ctx is done
+func (c *HttpClient) DownloadFileWithContext(ctx context.Context, url string, filepath string, header map[string]string) error {
+	return c.DownloadFileWithOptions(ctx, url, filepath, header, nil)
 }
 
-func showRespTimeLog(logname string, ptime time.Time) {
-	diff := float32(time.Now().UnixNano()-ptime.UnixNano()) / 1000000000
-	if diff > 2 {
-		log.Println(logname, "response time:", fmt.Sprintf("%.2f s", diff))
+func (c *HttpClient) showRespTimeLog(logname string, ptime time.Time) {
+	diff := time.Since(ptime)
+	if c.SlowRequestThreshold > 0 && diff > c.SlowRequestThreshold {
+		c.getLogger().Warn("slow response", "url", logname, "response_time", fmt.Sprintf("%.2f s", diff.Seconds()))
 	}
 }
@@ -0,0 +1,95 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// DecodeError is returned when the response body can not be decoded, Body keeps the raw response body
+type DecodeError struct {
+	StatusCode int
+	Body       []byte
+	Err        error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decode response body error (status code %d): %v", e.StatusCode, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DecodeError) Is(target error) bool {
+	return target == ErrDecode
+}
+
+// DoJSON send the request and decode the json response body into out,
+// out can be any pointer accepted by json.Unmarshal, e.g. a struct, a slice or an interface{}.
+// The body is not decoded when out is nil or the response body is empty.
+func (c *HttpClient) DoJSON(req *http.Request, out interface{}) (int, error) {
+	if req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", "application/json")
+	}
+	client := c.getClient()
+	res, err := c.do(client, req)
+	defer c.closeIdleConnections(client)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	return c.decodeJSONBody(res, out)
+}
+
+// SendJSONRequestWithContext marshal in as json request body and decode the json response body into out,
+// in is sent as is when it is a string or []byte, and no body is sent when it is nil
+func (c *HttpClient) SendJSONRequestWithContext(ctx context.Context, method, url string, in interface{}, out interface{}, header map[string]string) (int, error) {
+	var body []byte
+	switch v := in.(type) {
+	case nil:
+	case string:
+		body = []byte(v)
+	case []byte:
+		body = v
+	default:
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			c.getLogger().Error("SendJSONRequest json marshal error", "url", url, "error", err)
+			return 0, newRequestError(method, url, err)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		c.getLogger().Error("SendJSONRequest http client new request error", "url", url, "error", err)
+		return 0, newRequestError(method, url, err)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	setHeader(req, header)
+	return c.DoJSON(req, out)
+}
+
+// SendJSONRequest marshal in as json request body and decode the json response body into out
+func (c *HttpClient) SendJSONRequest(method, url string, in interface{}, out interface{}, header map[string]string) (int, error) {
+	return c.SendJSONRequestWithContext(context.Background(), method, url, in, out, header)
+}
+
+func (c *HttpClient) decodeJSONBody(res *http.Response, out interface{}) (int, error) {
+	body, err := c.readBody(res)
+	if err != nil {
+		return res.StatusCode, err
+	}
+	body = trimBOM(body)
+	if out == nil || len(bytes.TrimSpace(body)) == 0 {
+		return res.StatusCode, nil
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return res.StatusCode, &DecodeError{StatusCode: res.StatusCode, Body: body, Err: err}
+	}
+	return res.StatusCode, nil
+}
@@ -0,0 +1,32 @@
+package network
+
+import (
+	"sync"
+
+	"github.com/NovanHsiu/goutil/logger"
+)
+
+var (
+	defaultLoggerMu sync.RWMutex
+	defaultLogger   = logger.NewNopLogger()
+)
+
+// SetLogger set the logger of network package, it is used by HttpClient whose Logger is nil.
+// A nil logger discards everything, which is the default.
+func SetLogger(l logger.Logger) {
+	if l == nil {
+		l = logger.NewNopLogger()
+	}
+	defaultLoggerMu.Lock()
+	defer defaultLoggerMu.Unlock()
+	defaultLogger = l
+}
+
+func (c *HttpClient) getLogger() logger.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	defaultLoggerMu.RLock()
+	defer defaultLoggerMu.RUnlock()
+	return defaultLogger
+}
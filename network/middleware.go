@@ -0,0 +1,165 @@
+package network
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Middleware wrap the round tripper of HttpClient, it is called on every attempt of a request
+type Middleware func(next http.RoundTripper) http.RoundTripper
+
+// RoundTripperFunc adapt an ordinary function to http.RoundTripper
+type RoundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// RequestInterceptor create a middleware which is called before the request is sent,
+// e.g. to add auth headers or request id. The request is not sent when fn returns error.
+func RequestInterceptor(fn func(req *http.Request) error) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if err := fn(req); err != nil {
+				if req.Body != nil {
+					req.Body.Close()
+				}
+				return nil, err
+			}
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// ResponseInterceptor create a middleware which is called after the response headers are received,
+// the response is discarded and the error is returned when fn returns error
+func ResponseInterceptor(fn func(req *http.Request, res *http.Response) error) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			res, err := next.RoundTrip(req)
+			if err != nil {
+				return res, err
+			}
+			if err := fn(req, res); err != nil {
+				res.Body.Close()
+				return nil, err
+			}
+			return res, nil
+		})
+	}
+}
+
+// Use append middlewares to the client, the first one is the outermost and sees the request first
+func (c *HttpClient) Use(middlewares ...Middleware) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.middlewares = append(c.middlewares, middlewares...)
+}
+
+// SetMiddlewares replace all middlewares of the client include the default logging and timing middlewares
+func (c *HttpClient) SetMiddlewares(middlewares ...Middleware) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.middlewares = append([]Middleware(nil), middlewares...)
+}
+
+// LoggingMiddleware log the transport error of requests, it is used by default
+func (c *HttpClient) LoggingMiddleware() Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			res, err := next.RoundTrip(req)
+			if err != nil {
+				c.getLogger().Error("http client do error", "method", req.Method, "url", req.URL.String(), "error", err)
+			}
+			return res, err
+		})
+	}
+}
+
+// TimingMiddleware log the request whose response is slow, it is used by default
+func (c *HttpClient) TimingMiddleware() Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			pt := time.Now()
+			res, err := next.RoundTrip(req)
+			if err == nil {
+				c.showRespTimeLog(req.URL.String(), pt)
+			}
+			return res, err
+		})
+	}
+}
+
+// middlewareTransport run the built-in middlewares and the middlewares of the client around the base transport,
+// middlewares registered after the client is created are applied to the next request
+type middlewareTransport struct {
+	c    *HttpClient
+	base http.RoundTripper
+}
+
+func (t *middlewareTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.c.mu.RLock()
+	middlewares := t.c.middlewares
+	t.c.mu.RUnlock()
+	var next http.RoundTripper = RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		res, err := t.base.RoundTrip(req)
+		if s, ok := req.Context().Value(sentKey{}).(*sent); ok {
+			s.record(err)
+		}
+		return res, err
+	})
+	inners := t.c.innerBuiltinMiddlewares()
+	for i := len(inners) - 1; i >= 0; i-- {
+		next = inners[i](next)
+	}
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		next = middlewares[i](next)
+	}
+	builtins := t.c.builtinMiddlewares()
+	for i := len(builtins) - 1; i >= 0; i-- {
+		next = builtins[i](next)
+	}
+	return next.RoundTrip(req)
+}
+
+// builtinMiddlewares are the features configured by the fields of HttpClient, they are outside of
+// the middlewares of the client, and each of them does nothing when its feature is disabled
+func (c *HttpClient) builtinMiddlewares() []Middleware {
+	return []Middleware{
+		c.cacheMiddleware,
+		c.tokenMiddleware,
+		c.circuitBreakerMiddleware,
+		c.rateLimiterMiddleware,
+	}
+}
+
+// innerBuiltinMiddlewares are the features which must see the final request, they are inside of
+// the middlewares of the client. The recorder is outside of the others, so it records plain bodies
+// without the per-attempt nonces, compression and signatures.
+func (c *HttpClient) innerBuiltinMiddlewares() []Middleware {
+	return []Middleware{
+		c.recorderMiddleware,
+		c.wsSecurityMiddleware,
+		c.compressionMiddleware,
+		c.signerMiddleware,
+	}
+}
+
+func (t *middlewareTransport) CloseIdleConnections() {
+	if ci, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+}
+
+// isCrossHostRedirect report whether req is a redirect to another host than the one the caller sent the request to,
+// the credentials added by the middlewares must not follow it, as http.Client does for the Authorization header
+func isCrossHostRedirect(req *http.Request) bool {
+	if req.Response == nil {
+		return false
+	}
+	if s, ok := req.Context().Value(sentKey{}).(*sent); ok {
+		return !strings.EqualFold(req.URL.Host, s.host)
+	}
+	return req.Response.Request == nil || !strings.EqualFold(req.URL.Host, req.Response.Request.URL.Host)
+}
@@ -0,0 +1,430 @@
+// Package mock is an in-process stub server for testing code which uses network.HttpClient
+package mock
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NovanHsiu/goutil/network"
+)
+
+// Call is a request received by Server
+type Call struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   []byte
+	// Stub is the stub which answered the call, nil when no stub matched
+	Stub *Stub
+}
+
+// Server answer requests by the stubs registered with On, the latest registered stub is matched first.
+// Requests matched by no stub are answered with 404.
+type Server struct {
+	URL string
+
+	server *httptest.Server
+	closed chan struct{}
+	once   sync.Once
+	mu     sync.Mutex
+	stubs  []*Stub
+	calls  []Call
+}
+
+// NewServer start a stub server over http
+func NewServer() *Server {
+	s := &Server{closed: make(chan struct{})}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.URL = s.server.URL
+	return s
+}
+
+// NewTLSServer start a stub server over https, the certificate is trusted by the client of Client
+func NewTLSServer() *Server {
+	s := &Server{closed: make(chan struct{})}
+	s.server = httptest.NewTLSServer(http.HandlerFunc(s.handle))
+	s.URL = s.server.URL
+	return s
+}
+
+// Close stop the server, the requests waiting for a timeout fault are released
+func (s *Server) Close() {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+	s.server.Close()
+}
+
+// Client return a HttpClient which sends every request to the server whatever host its url has,
+// so code with production urls can be tested as is. The original host is kept in the Host header.
+func (s *Server) Client() *network.HttpClient {
+	client := network.NewHttpClient(10, false, true)
+	if cert := s.server.Certificate(); cert != nil {
+		client.SetTLSConfig(&network.TLSConfig{CAPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})})
+	}
+	target, _ := url.Parse(s.URL)
+	client.Use(func(next http.RoundTripper) http.RoundTripper {
+		return network.RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			redirected := req.Clone(req.Context())
+			redirected.URL.Scheme = target.Scheme
+			redirected.URL.Host = target.Host
+			if redirected.Host == "" {
+				redirected.Host = req.URL.Host
+			}
+			return next.RoundTrip(redirected)
+		})
+	})
+	return client
+}
+
+// On register a stub of the method and path, an empty method matches every method,
+// and a path ending with "*" matches every path with the prefix before it
+func (s *Server) On(method, path string) *Stub {
+	stub := &Stub{method: method, path: path, query: url.Values{}, header: http.Header{}, status: http.StatusOK}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stubs = append(s.stubs, stub)
+	return stub
+}
+
+// Reset remove every stub and call
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stubs = nil
+	s.calls = nil
+}
+
+// Calls return the calls received by the server in order
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// CallsTo return the calls of the method and path received by the server in order
+func (s *Server) CallsTo(method, path string) []Call {
+	var calls []Call
+	for _, call := range s.Calls() {
+		if strings.EqualFold(call.Method, method) && call.Path == path {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// Unmatched return the calls which no stub matched
+func (s *Server) Unmatched() []Call {
+	var calls []Call
+	for _, call := range s.Calls() {
+		if call.Stub == nil {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	call := Call{Method: r.Method, Path: r.URL.Path, Query: r.URL.Query(), Header: r.Header.Clone(), Body: body}
+	s.mu.Lock()
+	for i := len(s.stubs) - 1; i >= 0; i-- {
+		if s.stubs[i].matches(&call) {
+			call.Stub = s.stubs[i]
+			break
+		}
+	}
+	s.calls = append(s.calls, call)
+	s.mu.Unlock()
+	if call.Stub == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		msg, _ := json.Marshal(fmt.Sprintf("no stub matches %s %s", r.Method, r.URL.RequestURI()))
+		w.Write([]byte(`{"error":` + string(msg) + `}`))
+		return
+	}
+	call.Stub.respond(w, r, s.closed)
+}
+
+// fault is the failure injected by a stub instead of a response
+type fault int
+
+const (
+	noFault fault = iota
+	timeoutFault
+	resetFault
+)
+
+// Stub match requests and answer them, it is configured by chaining its methods
+type Stub struct {
+	method   string
+	path     string
+	query    url.Values
+	header   http.Header
+	jsonBody interface{}
+	hasJSON  bool
+
+	status     int
+	resHeader  http.Header
+	body       []byte
+	err        error
+	delay      time.Duration
+	fault      fault
+	chunkSize  int
+	chunkDelay time.Duration
+	mu         sync.Mutex
+	callCount  int
+}
+
+// WithQuery match requests whose query parameter key has value
+func (st *Stub) WithQuery(key, value string) *Stub {
+	st.query.Add(key, value)
+	return st
+}
+
+// WithHeader match requests whose header key has value
+func (st *Stub) WithHeader(key, value string) *Stub {
+	st.header.Add(key, value)
+	return st
+}
+
+// WithJSONBody match requests whose json body equals v after both are decoded,
+// v can be a json string, []byte or a value marshaled by encoding/json
+func (st *Stub) WithJSONBody(v interface{}) *Stub {
+	var data []byte
+	switch b := v.(type) {
+	case string:
+		data = []byte(b)
+	case []byte:
+		data = b
+	default:
+		data, st.err = json.Marshal(v)
+	}
+	if st.err == nil {
+		st.err = json.Unmarshal(data, &st.jsonBody)
+	}
+	st.hasJSON = true
+	return st
+}
+
+func (st *Stub) matches(call *Call) bool {
+	if st.method != "" && !strings.EqualFold(st.method, call.Method) {
+		return false
+	}
+	if strings.HasSuffix(st.path, "*") {
+		if !strings.HasPrefix(call.Path, strings.TrimSuffix(st.path, "*")) {
+			return false
+		}
+	} else if st.path != call.Path {
+		return false
+	}
+	for key, values := range st.query {
+		for _, value := range values {
+			if !contains(call.Query[key], value) {
+				return false
+			}
+		}
+	}
+	for key, values := range st.header {
+		for _, value := range values {
+			if !contains(call.Header.Values(key), value) {
+				return false
+			}
+		}
+	}
+	if st.hasJSON {
+		var body interface{}
+		if err := json.Unmarshal(call.Body, &body); err != nil || !reflect.DeepEqual(body, st.jsonBody) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Respond answer with the status, header and body
+func (st *Stub) Respond(status int, header http.Header, body []byte) *Stub {
+	st.status = status
+	st.resHeader = header.Clone()
+	st.body = body
+	return st
+}
+
+// RespondJSON answer with v marshaled by encoding/json, v is sent as is when it is a string or []byte
+func (st *Stub) RespondJSON(status int, v interface{}) *Stub {
+	var body []byte
+	switch b := v.(type) {
+	case string:
+		body = []byte(b)
+	case []byte:
+		body = b
+	default:
+		body, st.err = json.Marshal(v)
+	}
+	return st.Respond(status, http.Header{"Content-Type": {"application/json"}}, body)
+}
+
+// RespondSoap answer with body wrapped in a SOAP 1.1 envelope, body is marshaled by encoding/xml
+// unless it is a string or []byte
+func (st *Stub) RespondSoap(status int, body interface{}) *Stub {
+	envelope, err := network.BuildSoapEnvelope(network.Soap11, nil, body)
+	if err != nil {
+		st.err = err
+	}
+	return st.Respond(status, http.Header{"Content-Type": {"text/xml; charset=utf-8"}}, envelope)
+}
+
+// RespondSoapFault answer with a SOAP 1.1 Fault of the code and message and status 500
+func (st *Stub) RespondSoapFault(code, message string) *Stub {
+	var buf bytes.Buffer
+	buf.WriteString("<soap:Fault><faultcode>")
+	xml.EscapeText(&buf, []byte(code))
+	buf.WriteString("</faultcode><faultstring>")
+	xml.EscapeText(&buf, []byte(message))
+	buf.WriteString("</faultstring></soap:Fault>")
+	return st.RespondSoap(http.StatusInternalServerError, buf.String())
+}
+
+// RespondFile answer with the content of the file at path
+func (st *Stub) RespondFile(status int, path, contentType string) *Stub {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		st.err = err
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	return st.Respond(status, http.Header{"Content-Type": {contentType}}, body)
+}
+
+// WithDelay wait before sending the response
+func (st *Stub) WithDelay(delay time.Duration) *Stub {
+	st.delay = delay
+	return st
+}
+
+// Timeout never answer, the request waits until the client gives up or the server is closed
+func (st *Stub) Timeout() *Stub {
+	st.fault = timeoutFault
+	return st
+}
+
+// Reset close the connection with a TCP reset instead of answering
+func (st *Stub) Reset() *Stub {
+	st.fault = resetFault
+	return st
+}
+
+// SlowBody send the response body chunkSize bytes at a time with interval between chunks
+func (st *Stub) SlowBody(chunkSize int, interval time.Duration) *Stub {
+	if chunkSize < 1 {
+		chunkSize = 1
+	}
+	st.chunkSize = chunkSize
+	st.chunkDelay = interval
+	return st
+}
+
+// CallCount return the number of calls answered by the stub
+func (st *Stub) CallCount() int {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.callCount
+}
+
+func (st *Stub) respond(w http.ResponseWriter, r *http.Request, closed chan struct{}) {
+	st.mu.Lock()
+	st.callCount++
+	st.mu.Unlock()
+	if st.err != nil {
+		http.Error(w, "invalid stub: "+st.err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !wait(r, closed, st.delay) {
+		return
+	}
+	switch st.fault {
+	case timeoutFault:
+		select {
+		case <-r.Context().Done():
+		case <-closed:
+		}
+		return
+	case resetFault:
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				if tcp, ok := conn.(*net.TCPConn); ok {
+					tcp.SetLinger(0)
+				}
+				conn.Close()
+				return
+			}
+		}
+		panic(http.ErrAbortHandler)
+	}
+	for key, values := range st.resHeader {
+		w.Header()[key] = values
+	}
+	if st.chunkSize == 0 {
+		w.WriteHeader(st.status)
+		w.Write(st.body)
+		return
+	}
+	// without Content-Length so the client sees the body arriving slowly
+	w.WriteHeader(st.status)
+	flusher, _ := w.(http.Flusher)
+	for body := st.body; len(body) > 0; {
+		n := st.chunkSize
+		if n > len(body) {
+			n = len(body)
+		}
+		if _, err := w.Write(body[:n]); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		body = body[n:]
+		if len(body) > 0 && !wait(r, closed, st.chunkDelay) {
+			return
+		}
+	}
+}
+
+// wait return false when the request is canceled or the server is closed before delay
+func wait(r *http.Request, closed chan struct{}, delay time.Duration) bool {
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	case <-closed:
+		return false
+	}
+}
@@ -0,0 +1,267 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errFilePartConsumed = errors.New("file part reader has been consumed and can not be sent again")
+
+// FilePart is a file of multipart form, the content is streamed from Open when the request is sent
+type FilePart struct {
+	ParamName string
+	FileName  string
+	// ContentType of this part, default is application/octet-stream
+	ContentType string
+	// Size of the content in bytes, 0 means unknown and the form is sent with chunked transfer encoding
+	Size int64
+	// Open return the content of this part, it is called again when the request is retried
+	Open func() (io.ReadCloser, error)
+	// openOnce is true when Open can be called only once, so the request can not be sent again
+	openOnce bool
+}
+
+// NewFilePart create a file part from the file of path
+func NewFilePart(paramName, path string) (FilePart, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return FilePart{}, newFileError("stat", path, err)
+	}
+	if info.IsDir() {
+		return FilePart{}, newFileError("open", path, errors.New("is a directory"))
+	}
+	return FilePart{
+		ParamName: paramName,
+		FileName:  filepath.Base(path),
+		Size:      info.Size(),
+		Open: func() (io.ReadCloser, error) {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil, newFileError("open", path, err)
+			}
+			return f, nil
+		},
+	}, nil
+}
+
+// NewReaderFilePart create a file part from reader, the reader can be sent again on retry only if it is an io.Seeker
+func NewReaderFilePart(paramName, fileName, contentType string, reader io.Reader) FilePart {
+	part := FilePart{
+		ParamName:   paramName,
+		FileName:    fileName,
+		ContentType: contentType,
+	}
+	if lr, ok := reader.(interface{ Len() int }); ok {
+		part.Size = int64(lr.Len())
+	}
+	if seeker, ok := reader.(io.Seeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		part.Open = func() (io.ReadCloser, error) {
+			if err != nil {
+				return nil, err
+			}
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, err
+			}
+			return ioutil.NopCloser(reader), nil
+		}
+		return part
+	}
+	opened := false
+	part.openOnce = true
+	part.Open = func() (io.ReadCloser, error) {
+		if opened {
+			return nil, errFilePartConsumed
+		}
+		opened = true
+		return ioutil.NopCloser(reader), nil
+	}
+	return part
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// multipartBody stream the multipart payload through a pipe, the payload is rebuilt on every call of getBody
+// so the request can be sent again on retry, unless a part can be opened only once
+type multipartBody struct {
+	boundary string
+	params   map[string]string
+	parts    []FilePart
+	// length of the whole payload, -1 means unknown
+	length int64
+}
+
+func newMultipartBody(params map[string]string, parts []FilePart) (*multipartBody, error) {
+	m := &multipartBody{
+		boundary: multipart.NewWriter(nil).Boundary(),
+		params:   params,
+		parts:    parts,
+	}
+	for _, part := range parts {
+		if part.Open == nil {
+			return nil, fmt.Errorf("file part %s of %s has no content", part.FileName, part.ParamName)
+		}
+	}
+	// count the size of multipart headers and boundaries, then add the size of files
+	counter := &countWriter{}
+	if err := m.write(counter, false); err != nil {
+		return nil, err
+	}
+	m.length = counter.n
+	for _, part := range parts {
+		if part.Size <= 0 {
+			m.length = -1
+			break
+		}
+		m.length += part.Size
+	}
+	return m, nil
+}
+
+func (m *multipartBody) contentType() string {
+	return "multipart/form-data; boundary=" + m.boundary
+}
+
+func (m *multipartBody) getBody() (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(m.write(pw, true))
+	}()
+	return pr, nil
+}
+
+func (m *multipartBody) newRequest(ctx context.Context, method, url string) (*http.Request, error) {
+	body, _ := m.getBody()
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	if m.replayable() {
+		req.GetBody = m.getBody
+	}
+	req.ContentLength = m.length
+	req.Header.Set("Content-Type", m.contentType())
+	return req, nil
+}
+
+// replayable report whether every part can be opened again, otherwise GetBody is left nil
+// so retries and the middlewares which read the body know it can not be sent again
+func (m *multipartBody) replayable() bool {
+	for _, part := range m.parts {
+		if part.openOnce {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *multipartBody) write(w io.Writer, withContent bool) error {
+	writer := multipart.NewWriter(w)
+	if err := writer.SetBoundary(m.boundary); err != nil {
+		return err
+	}
+	for _, part := range m.parts {
+		if err := writeFilePart(writer, part, withContent); err != nil {
+			return err
+		}
+	}
+	for key, val := range m.params {
+		if err := writer.WriteField(key, val); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
+
+func writeFilePart(writer *multipart.Writer, part FilePart, withContent bool) error {
+	contentType := part.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+		quoteEscaper.Replace(part.ParamName), quoteEscaper.Replace(part.FileName)))
+	h.Set("Content-Type", contentType)
+	pw, err := writer.CreatePart(h)
+	if err != nil || !withContent {
+		return err
+	}
+	content, err := part.Open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	n, err := io.Copy(pw, content)
+	if err != nil {
+		return err
+	}
+	if part.Size > 0 && n != part.Size {
+		return fmt.Errorf("file part %s size changed, expected %d bytes but read %d bytes", part.FileName, part.Size, n)
+	}
+	return nil
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func sendFilesToParts(sendFiles []SendFile) ([]FilePart, error) {
+	var parts []FilePart
+	for _, sendFile := range sendFiles {
+		for _, path := range sendFile.Paths {
+			part, err := NewFilePart(sendFile.ParamName, path)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+		}
+	}
+	return parts, nil
+}
+
+func (c *HttpClient) SendFormDataWithFilePartsRequest(method, url string, params map[string]string, parts []FilePart, header map[string]string) (int, map[string]interface{}, error) {
+	return c.SendFormDataWithFilePartsRequestWithContext(context.Background(), method, url, params, parts, header)
+}
+
+// SendFormDataWithFilePartsRequestWithContext send multipart form request, files are streamed to the server
+// without buffering the whole payload in memory
+func (c *HttpClient) SendFormDataWithFilePartsRequestWithContext(ctx context.Context, method, url string, params map[string]string, parts []FilePart, header map[string]string) (int, map[string]interface{}, error) {
+	mb, err := newMultipartBody(params, parts)
+	if err != nil {
+		c.getLogger().Error("SendFormDataWithFilePartsRequest build multipart body error", "url", url, "error", err)
+		return 0, nil, newRequestError(method, url, err)
+	}
+	req, err := mb.newRequest(ctx, method, url)
+	if err != nil {
+		c.getLogger().Error("SendFormDataWithFilePartsRequest http new request error", "url", url, "error", err)
+		return 0, nil, newRequestError(method, url, err)
+	}
+	setHeader(req, header)
+	client := c.getClient()
+	res, err := c.do(client, req)
+	defer c.closeIdleConnections(client)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	return c.extractBody(res)
+}
+
+func (c *HttpClient) PostFormDataWithFilePartsRequest(url string, params map[string]string, parts []FilePart, header map[string]string) (int, map[string]interface{}, error) {
+	return c.SendFormDataWithFilePartsRequest("POST", url, params, parts, header)
+}
@@ -0,0 +1,268 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token is an OAuth2 access token
+type Token struct {
+	AccessToken  string
+	TokenType    string
+	RefreshToken string
+	// Expiry is zero when the token never expires
+	Expiry time.Time
+}
+
+// valid report whether the token can still be used for delta
+func (t *Token) valid(delta time.Duration) bool {
+	return t != nil && t.AccessToken != "" && (t.Expiry.IsZero() || time.Now().Add(delta).Before(t.Expiry))
+}
+
+// authorization return the value of Authorization header
+func (t *Token) authorization() string {
+	tokenType := t.TokenType
+	if tokenType == "" || strings.EqualFold(tokenType, "bearer") {
+		tokenType = "Bearer"
+	}
+	return tokenType + " " + t.AccessToken
+}
+
+// TokenSource supply the token attached to the requests of HttpClient
+type TokenSource interface {
+	// Token return a valid token, rejected is the token answered by 401 which must not be returned again,
+	// it is nil unless the token has to be refreshed
+	Token(ctx context.Context, rejected *Token) (*Token, error)
+}
+
+// OAuth2Error is the error response of the token endpoint
+type OAuth2Error struct {
+	StatusCode  int
+	Code        string
+	Description string
+	Body        []byte
+}
+
+func (e *OAuth2Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("oauth2 token request failed, status code is %d", e.StatusCode)
+	}
+	return fmt.Sprintf("oauth2 token request failed, status code is %d: %s %s", e.StatusCode, e.Code, e.Description)
+}
+
+// OAuth2Config is the client registered on the authorization server
+type OAuth2Config struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// AuthInParams send client_id and client_secret in the form instead of basic authentication
+	AuthInParams bool
+	// EndpointParams are extra values of the token request, e.g. audience
+	EndpointParams url.Values
+	// ExpiryDelta refresh the token before it expires, default is 10 seconds
+	ExpiryDelta time.Duration
+	// OnToken is called after a new token is fetched, e.g. to persist a rotated refresh token
+	OnToken func(token *Token)
+}
+
+// OAuth2TokenSource fetch tokens from the token endpoint and cache them until shortly before they expire,
+// concurrent callers share one token request
+type OAuth2TokenSource struct {
+	client       *HttpClient
+	config       OAuth2Config
+	grantType    string
+	mu           sync.Mutex
+	token        *Token
+	refreshToken string
+	call         *tokenCall
+}
+
+type tokenCall struct {
+	done  chan struct{}
+	token *Token
+	err   error
+}
+
+// NewClientCredentialsTokenSource create a token source of the client credentials grant,
+// token requests are sent by client, or by a default client when it is nil
+func NewClientCredentialsTokenSource(client *HttpClient, config OAuth2Config) *OAuth2TokenSource {
+	return newOAuth2TokenSource(client, config, "client_credentials", "")
+}
+
+// NewRefreshTokenSource create a token source of the refresh token grant,
+// the refresh token is replaced when the server rotates it
+func NewRefreshTokenSource(client *HttpClient, config OAuth2Config, refreshToken string) *OAuth2TokenSource {
+	return newOAuth2TokenSource(client, config, "refresh_token", refreshToken)
+}
+
+func newOAuth2TokenSource(client *HttpClient, config OAuth2Config, grantType, refreshToken string) *OAuth2TokenSource {
+	if client == nil {
+		client = NewDefaultHttpClient()
+	}
+	if config.ExpiryDelta == 0 {
+		config.ExpiryDelta = 10 * time.Second
+	}
+	return &OAuth2TokenSource{client: client, config: config, grantType: grantType, refreshToken: refreshToken}
+}
+
+// Token implements TokenSource
+func (s *OAuth2TokenSource) Token(ctx context.Context, rejected *Token) (*Token, error) {
+	s.mu.Lock()
+	if s.token.valid(s.config.ExpiryDelta) && (rejected == nil || s.token.AccessToken != rejected.AccessToken) {
+		token := s.token
+		s.mu.Unlock()
+		return token, nil
+	}
+	call := s.call
+	if call == nil {
+		call = &tokenCall{done: make(chan struct{})}
+		s.call = call
+		go s.fetch(call, s.refreshToken)
+	}
+	s.mu.Unlock()
+	select {
+	case <-call.done:
+		return call.token, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fetch request a token in background so a canceled caller does not fail the others waiting for it
+func (s *OAuth2TokenSource) fetch(call *tokenCall, refreshToken string) {
+	call.token, call.err = s.requestToken(refreshToken)
+	s.mu.Lock()
+	if call.err == nil {
+		s.token = call.token
+		if call.token.RefreshToken != "" {
+			s.refreshToken = call.token.RefreshToken
+		}
+	}
+	s.call = nil
+	s.mu.Unlock()
+	if call.err == nil && s.config.OnToken != nil {
+		s.config.OnToken(call.token)
+	}
+	close(call.done)
+}
+
+func (s *OAuth2TokenSource) requestToken(refreshToken string) (*Token, error) {
+	values := url.Values{"grant_type": {s.grantType}}
+	if s.grantType == "refresh_token" {
+		values.Set("refresh_token", refreshToken)
+	}
+	if len(s.config.Scopes) > 0 {
+		values.Set("scope", strings.Join(s.config.Scopes, " "))
+	}
+	if s.config.AuthInParams {
+		values.Set("client_id", s.config.ClientID)
+		if s.config.ClientSecret != "" {
+			values.Set("client_secret", s.config.ClientSecret)
+		}
+	}
+	for key, vs := range s.config.EndpointParams {
+		values[key] = append([]string(nil), vs...)
+	}
+	ctx := context.WithValue(context.Background(), skipTokenKey{}, true)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.TokenURL, strings.NewReader(values.Encode()))
+	if err != nil {
+		return nil, newRequestError(http.MethodPost, s.config.TokenURL, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if !s.config.AuthInParams {
+		req.SetBasicAuth(url.QueryEscape(s.config.ClientID), url.QueryEscape(s.config.ClientSecret))
+	}
+	client := s.client.getClient()
+	res, err := s.client.do(client, req)
+	defer s.client.closeIdleConnections(client)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := s.client.readBody(res)
+	if err != nil {
+		return nil, err
+	}
+	var tokenRes struct {
+		AccessToken      string      `json:"access_token"`
+		TokenType        string      `json:"token_type"`
+		RefreshToken     string      `json:"refresh_token"`
+		ExpiresIn        json.Number `json:"expires_in"`
+		Error            string      `json:"error"`
+		ErrorDescription string      `json:"error_description"`
+	}
+	decodeErr := json.Unmarshal(trimBOM(body), &tokenRes)
+	if res.StatusCode >= 400 || tokenRes.Error != "" {
+		return nil, &OAuth2Error{StatusCode: res.StatusCode, Code: tokenRes.Error, Description: tokenRes.ErrorDescription, Body: body}
+	}
+	if decodeErr != nil {
+		return nil, &DecodeError{StatusCode: res.StatusCode, Body: body, Err: decodeErr}
+	}
+	if tokenRes.AccessToken == "" {
+		return nil, &OAuth2Error{StatusCode: res.StatusCode, Description: "no access_token in response", Body: body}
+	}
+	token := &Token{AccessToken: tokenRes.AccessToken, TokenType: tokenRes.TokenType, RefreshToken: tokenRes.RefreshToken}
+	if seconds, err := strconv.ParseInt(tokenRes.ExpiresIn.String(), 10, 64); err == nil && seconds > 0 {
+		token.Expiry = time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+	return token, nil
+}
+
+type skipTokenKey struct{}
+
+// tokenMiddleware attach the token of TokenSource to requests without Authorization header, except redirects
+// to another host, and send the request once more with a refreshed token when the response is 401
+func (c *HttpClient) tokenMiddleware(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		source := c.TokenSource
+		if source == nil || req.Header.Get("Authorization") != "" || req.Context().Value(skipTokenKey{}) != nil || isCrossHostRedirect(req) {
+			return next.RoundTrip(req)
+		}
+		ctx := req.Context()
+		token, err := source.Token(ctx, nil)
+		if err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, err
+		}
+		authReq := req.Clone(ctx)
+		authReq.Header.Set("Authorization", token.authorization())
+		res, err := next.RoundTrip(authReq)
+		if err != nil || res.StatusCode != http.StatusUnauthorized {
+			return res, err
+		}
+		if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			// body can not be replayed
+			return res, nil
+		}
+		token, err = source.Token(ctx, token)
+		if err != nil {
+			// keep the 401 response when the token can not be refreshed
+			return res, nil
+		}
+		retryReq := req.Clone(ctx)
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return res, nil
+			}
+			retryReq.Body = body
+		}
+		io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096))
+		res.Body.Close()
+		retryReq.Header.Set("Authorization", token.authorization())
+		return next.RoundTrip(retryReq)
+	})
+}
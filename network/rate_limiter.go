@@ -0,0 +1,243 @@
+package network
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit limit the requests matched by Prefix
+type RateLimit struct {
+	// Prefix is a host like "api.example.com" or an url prefix like "https://api.example.com/v1/",
+	// an empty prefix matches every request and keeps a separate limit for each host
+	Prefix string
+	// RequestsPerSecond is the rate tokens are added to the bucket, 0 means no rate limit
+	RequestsPerSecond float64
+	// Burst is the capacity of the bucket, default is 1
+	Burst int
+	// MaxConcurrent is the max requests in flight, a request is in flight until its response body is closed,
+	// 0 means no limit
+	MaxConcurrent int
+}
+
+// RateLimiter block requests until the token bucket of their matched RateLimit has a token,
+// the RateLimit with the longest matched prefix is used
+type RateLimiter struct {
+	Limits []RateLimit
+	// DisableAdaptive stop pausing the bucket when the response is 429 with Retry-After,
+	// or X-RateLimit-Remaining is 0 with X-RateLimit-Reset
+	DisableAdaptive bool
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// NewRateLimiter create a rate limiter with limits
+func NewRateLimiter(limits ...RateLimit) *RateLimiter {
+	return &RateLimiter{Limits: limits}
+}
+
+type bucket struct {
+	mu          sync.Mutex
+	rate        float64
+	burst       float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+	// sem hold a slot for each request in flight, nil means no limit
+	sem chan struct{}
+}
+
+func (l *RateLimiter) bucket(req *http.Request) *bucket {
+	var matched *RateLimit
+	key := ""
+	for i := range l.Limits {
+		limit := &l.Limits[i]
+		if !matchRateLimit(limit.Prefix, req) {
+			continue
+		}
+		if matched == nil || len(limit.Prefix) > len(matched.Prefix) {
+			matched = limit
+			key = strconv.Itoa(i) + " " + limit.Prefix
+		}
+	}
+	if matched == nil {
+		return nil
+	}
+	if matched.Prefix == "" {
+		key += req.URL.Host
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*bucket)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		burst := matched.Burst
+		if burst < 1 {
+			burst = 1
+		}
+		b = &bucket{
+			rate:   matched.RequestsPerSecond,
+			burst:  float64(burst),
+			tokens: float64(burst),
+			last:   time.Now(),
+		}
+		if matched.MaxConcurrent > 0 {
+			b.sem = make(chan struct{}, matched.MaxConcurrent)
+		}
+		l.buckets[key] = b
+	}
+	return b
+}
+
+func matchRateLimit(prefix string, req *http.Request) bool {
+	if prefix == "" {
+		return true
+	}
+	if !strings.Contains(prefix, "://") {
+		return strings.EqualFold(prefix, req.URL.Host) || strings.EqualFold(prefix, req.URL.Hostname())
+	}
+	return strings.HasPrefix(req.URL.String(), prefix)
+}
+
+// wait block until a token is available or ctx is done
+func (b *bucket) wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		var delay time.Duration
+		if now.Before(b.pausedUntil) {
+			delay = b.pausedUntil.Sub(now)
+		} else if b.rate > 0 {
+			b.tokens += now.Sub(b.last).Seconds() * b.rate
+			if b.tokens > b.burst {
+				b.tokens = b.burst
+			}
+			b.last = now
+			if b.tokens >= 1 {
+				b.tokens--
+			} else {
+				delay = time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+			}
+		}
+		b.mu.Unlock()
+		if delay <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (b *bucket) acquire(ctx context.Context) error {
+	if b.sem == nil {
+		return nil
+	}
+	select {
+	case b.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *bucket) release() {
+	if b.sem != nil {
+		<-b.sem
+	}
+}
+
+func (b *bucket) pause(until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until.After(b.pausedUntil) {
+		b.pausedUntil = until
+	}
+}
+
+// adapt pause the bucket by the rate limit headers of the response
+func (b *bucket) adapt(res *http.Response) {
+	now := time.Now()
+	if res.StatusCode == http.StatusTooManyRequests {
+		if wait, ok := parseRetryAfter(res.Header.Get("Retry-After")); ok {
+			b.pause(now.Add(wait))
+			return
+		}
+	}
+	if res.Header.Get("X-RateLimit-Remaining") != "0" {
+		return
+	}
+	reset, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil || reset <= 0 {
+		return
+	}
+	// X-RateLimit-Reset is either an unix timestamp or the seconds to wait
+	if reset > 1000000000 {
+		b.pause(time.Unix(reset, 0))
+	} else {
+		b.pause(now.Add(time.Duration(reset) * time.Second))
+	}
+}
+
+// releaseBody release the concurrency slot when the response body is closed
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *releaseBody) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+func (c *HttpClient) rateLimiterMiddleware(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		limiter := c.RateLimiter
+		if limiter == nil {
+			return next.RoundTrip(req)
+		}
+		b := limiter.bucket(req)
+		if b == nil {
+			return next.RoundTrip(req)
+		}
+		closeBody := func() {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+		}
+		if err := b.acquire(req.Context()); err != nil {
+			closeBody()
+			return nil, err
+		}
+		if err := b.wait(req.Context()); err != nil {
+			b.release()
+			closeBody()
+			return nil, err
+		}
+		res, err := next.RoundTrip(req)
+		if err != nil {
+			b.release()
+			return res, err
+		}
+		if !limiter.DisableAdaptive {
+			b.adapt(res)
+		}
+		if b.sem != nil {
+			res.Body = &releaseBody{ReadCloser: res.Body, release: b.release}
+		}
+		return res, nil
+	})
+}
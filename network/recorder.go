@@ -0,0 +1,380 @@
+package network
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// ErrNoRecordedInteraction is returned in replay mode when no recorded interaction matches the request
+var ErrNoRecordedInteraction = errors.New("no recorded interaction matches the request")
+
+// redactedValue replace the secrets in recordings
+const redactedValue = "REDACTED"
+
+// RecordMode is the mode of Recorder
+type RecordMode int
+
+const (
+	// RecordModeReplay serve responses from the fixture and fail on unmatched requests
+	RecordModeReplay RecordMode = iota
+	// RecordModeRecord send every request and save the interactions to the fixture, which is overwritten
+	RecordModeRecord
+	// RecordModeReplayOrRecord serve matched requests from the fixture, and send and record the others
+	RecordModeReplayOrRecord
+)
+
+// RecordedRequest is a request saved in the fixture
+type RecordedRequest struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	BodyBase64 bool        `json:"body_base64,omitempty"`
+}
+
+// RecordedResponse is a response saved in the fixture
+type RecordedResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	BodyBase64 bool        `json:"body_base64,omitempty"`
+}
+
+// Interaction is a request and its response saved in the fixture
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+// encodeBody return the body as text, or as base64 when it is not utf-8
+func encodeBody(body []byte) (string, bool) {
+	if utf8.Valid(body) {
+		return string(body), false
+	}
+	return base64.StdEncoding.EncodeToString(body), true
+}
+
+func decodeBody(body string, isBase64 bool) []byte {
+	if !isBase64 {
+		return []byte(body)
+	}
+	data, _ := base64.StdEncoding.DecodeString(body)
+	return data
+}
+
+// Matcher report whether a request matches a recorded request, both are redacted in the same way
+type Matcher func(req, recorded *RecordedRequest) bool
+
+// MatchMethod match the method
+func MatchMethod(req, recorded *RecordedRequest) bool {
+	return strings.EqualFold(req.Method, recorded.Method)
+}
+
+// MatchURL match the url, the order of query parameters is ignored
+func MatchURL(req, recorded *RecordedRequest) bool {
+	u1, err1 := url.Parse(req.URL)
+	u2, err2 := url.Parse(recorded.URL)
+	if err1 != nil || err2 != nil {
+		return req.URL == recorded.URL
+	}
+	return u1.Scheme == u2.Scheme && strings.EqualFold(u1.Host, u2.Host) && u1.EscapedPath() == u2.EscapedPath() &&
+		canonicalQuery(u1.Query()) == canonicalQuery(u2.Query())
+}
+
+// MatchBody match the body, the random boundaries of multipart bodies are ignored
+func MatchBody(req, recorded *RecordedRequest) bool {
+	return bytes.Equal(normalizedBody(req), normalizedBody(recorded))
+}
+
+func normalizedBody(r *RecordedRequest) []byte {
+	body := decodeBody(r.Body, r.BodyBase64)
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil && params["boundary"] != "" {
+		body = bytes.Replace(body, []byte(params["boundary"]), []byte("BOUNDARY"), -1)
+	}
+	return body
+}
+
+// MatchHeader match the values of the headers
+func MatchHeader(names ...string) Matcher {
+	return func(req, recorded *RecordedRequest) bool {
+		for _, name := range names {
+			if strings.Join(req.Header.Values(name), ",") != strings.Join(recorded.Header.Values(name), ",") {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Recorder save the interactions of HttpClient to a fixture file and replay them, so tests run without network.
+// It sees the requests after the middlewares of the client, and before the WS-Security header, compression
+// and signature are added, so the fixture keeps plain bodies which Redact can see.
+type Recorder struct {
+	Mode RecordMode
+	// Matchers must all match for a recorded interaction to be replayed, default is MatchMethod and MatchURL.
+	// Unused interactions are replayed first, so repeated requests get their responses in recorded order.
+	Matchers []Matcher
+	// RedactHeaders are the headers whose values are replaced by REDACTED in recordings,
+	// default is Authorization, Proxy-Authorization, Cookie, Set-Cookie and X-Api-Key
+	RedactHeaders []string
+	// RedactQuery are the query parameters whose values are replaced by REDACTED in recordings
+	RedactQuery []string
+	// Redact is called on every interaction before it is saved or matched, e.g. to remove secrets in bodies,
+	// Response is empty when it is called to match a request
+	Redact func(interaction *Interaction)
+
+	path         string
+	mu           sync.Mutex
+	interactions []*Interaction
+	used         []bool
+}
+
+// NewRecorder create a recorder of the fixture file at path, the fixture must exist in replay mode
+func NewRecorder(path string, mode RecordMode) (*Recorder, error) {
+	r := &Recorder{Mode: mode, path: path}
+	if mode == RecordModeRecord {
+		return r, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && mode == RecordModeReplayOrRecord {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &r.interactions); err != nil {
+		return nil, fmt.Errorf("invalid fixture %s: %v", path, err)
+	}
+	r.used = make([]bool, len(r.interactions))
+	return r, nil
+}
+
+// Interactions return the recorded interactions
+func (r *Recorder) Interactions() []Interaction {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	interactions := make([]Interaction, len(r.interactions))
+	for i, interaction := range r.interactions {
+		interactions[i] = *interaction
+	}
+	return interactions
+}
+
+func (r *Recorder) redactHeaders() []string {
+	if r.RedactHeaders == nil {
+		return []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+	}
+	return r.RedactHeaders
+}
+
+func (r *Recorder) redact(interaction *Interaction) {
+	for _, name := range r.redactHeaders() {
+		for _, header := range []http.Header{interaction.Request.Header, interaction.Response.Header} {
+			if values := header.Values(name); len(values) > 0 {
+				header[http.CanonicalHeaderKey(name)] = []string{redactedValue}
+			}
+		}
+	}
+	if len(r.RedactQuery) > 0 {
+		if u, err := url.Parse(interaction.Request.URL); err == nil {
+			query := u.Query()
+			for _, name := range r.RedactQuery {
+				if _, ok := query[name]; ok {
+					query.Set(name, redactedValue)
+				}
+			}
+			u.RawQuery = query.Encode()
+			interaction.Request.URL = u.String()
+		}
+	}
+	if r.Redact != nil {
+		r.Redact(interaction)
+	}
+}
+
+func (r *Recorder) match(req *RecordedRequest) int {
+	matchers := r.Matchers
+	if len(matchers) == 0 {
+		matchers = []Matcher{MatchMethod, MatchURL}
+	}
+	found := -1
+	for i, interaction := range r.interactions {
+		matched := true
+		for _, matcher := range matchers {
+			if !matcher(req, &interaction.Request) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		if !r.used[i] {
+			return i
+		}
+		if found < 0 {
+			found = i
+		}
+	}
+	return found
+}
+
+// recordRequest read the body of req, the body is put back so req can still be sent
+func recordRequest(req *http.Request) (*RecordedRequest, error) {
+	recorded := &RecordedRequest{Method: req.Method, URL: req.URL.String(), Header: req.Header.Clone()}
+	if req.Body == nil || req.Body == http.NoBody {
+		return recorded, nil
+	}
+	var body io.ReadCloser
+	if req.GetBody != nil {
+		var err error
+		if body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	} else {
+		body = req.Body
+	}
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if req.GetBody == nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	}
+	recorded.Body, recorded.BodyBase64 = encodeBody(data)
+	return recorded, nil
+}
+
+func (r *Recorder) replay(req *http.Request, i int) *http.Response {
+	r.used[i] = true
+	recorded := r.interactions[i].Response
+	body := decodeBody(recorded.Body, recorded.BodyBase64)
+	header := recorded.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(recorded.StatusCode) + " " + http.StatusText(recorded.StatusCode),
+		StatusCode:    recorded.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// record send the request and save the interaction, the response body is read and put back
+func (r *Recorder) record(next http.RoundTripper, req *http.Request, recorded *RecordedRequest) (*http.Response, error) {
+	res, err := next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	interaction := &Interaction{Request: *recorded, Response: RecordedResponse{StatusCode: res.StatusCode, Header: res.Header.Clone()}}
+	interaction.Response.Body, interaction.Response.BodyBase64 = encodeBody(body)
+	r.redact(interaction)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.interactions = append(r.interactions, interaction)
+	r.used = append(r.used, true)
+	if err := r.save(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// save must be called with r.mu held
+func (r *Recorder) save() error {
+	data, err := json.MarshalIndent(r.interactions, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(r.path), "."+filepath.Base(r.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), r.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Middleware return the middleware which records and replays the requests, it can also be set as
+// HttpClient.Recorder to see the requests after the middlewares of the client
+func (r *Recorder) Middleware() Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			recorded, err := recordRequest(req)
+			if err != nil {
+				return nil, err
+			}
+			if r.Mode != RecordModeRecord {
+				redacted := &Interaction{Request: *recorded}
+				redacted.Request.Header = recorded.Header.Clone()
+				r.redact(redacted)
+				r.mu.Lock()
+				i := r.match(&redacted.Request)
+				if i >= 0 {
+					res := r.replay(req, i)
+					r.mu.Unlock()
+					if req.Body != nil {
+						req.Body.Close()
+					}
+					return res, nil
+				}
+				r.mu.Unlock()
+				if r.Mode == RecordModeReplay {
+					if req.Body != nil {
+						req.Body.Close()
+					}
+					return nil, fmt.Errorf("%w: %s %s", ErrNoRecordedInteraction, req.Method, redacted.Request.URL)
+				}
+			}
+			return r.record(next, req, recorded)
+		})
+	}
+}
+
+func (c *HttpClient) recorderMiddleware(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		recorder := c.Recorder
+		if recorder == nil {
+			return next.RoundTrip(req)
+		}
+		return recorder.Middleware()(next).RoundTrip(req)
+	})
+}
@@ -0,0 +1,144 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+type maxResponseSizeKey struct{}
+
+// WithMaxResponseSize override the max response size of HttpClient for requests sent with the returned context,
+// 0 or less means no limit
+func WithMaxResponseSize(ctx context.Context, size int64) context.Context {
+	return context.WithValue(ctx, maxResponseSizeKey{}, size)
+}
+
+func (c *HttpClient) maxResponseSize(ctx context.Context) int64 {
+	if size, ok := ctx.Value(maxResponseSizeKey{}).(int64); ok {
+		return size
+	}
+	return c.MaxResponseSize
+}
+
+// limitedBody fail the reads beyond limit with ResponseTooLargeError, a body whose Content-Length is larger
+// than limit fails on the first read
+type limitedBody struct {
+	io.ReadCloser
+	res   *http.Response
+	limit int64
+	read  int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.res.ContentLength > b.limit || b.read > b.limit {
+		return 0, b.tooLarge()
+	}
+	// read at most one byte more than limit to find out the body is too large
+	if max := b.limit - b.read + 1; int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.read > b.limit {
+		return n - 1, b.tooLarge()
+	}
+	return n, err
+}
+
+func (b *limitedBody) tooLarge() error {
+	return &ResponseTooLargeError{StatusCode: b.res.StatusCode, Header: b.res.Header, Limit: b.limit}
+}
+
+// readBody read the whole response body within the max response size of the request,
+// an error is returned as ResponseTooLargeError or TransportError
+func (c *HttpClient) readBody(res *http.Response) ([]byte, error) {
+	var body io.Reader = res.Body
+	if limit := c.maxResponseSize(res.Request.Context()); limit > 0 {
+		body = &limitedBody{ReadCloser: res.Body, res: res, limit: limit}
+	}
+	data, err := ioutil.ReadAll(body)
+	if err == nil {
+		return data, nil
+	}
+	var tooLarge *ResponseTooLargeError
+	if errors.As(err, &tooLarge) {
+		c.getLogger().Error("response body too large", "url", res.Request.URL.String(), "limit", tooLarge.Limit)
+		return nil, err
+	}
+	return data, newTransportError(res.Request, err)
+}
+
+// streamBody release the connections of a client which is not reused when it is closed
+type streamBody struct {
+	io.ReadCloser
+	onClose func()
+}
+
+func (b *streamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.onClose()
+	return err
+}
+
+// DoStream send the request and return the response without reading its body, for large or unbounded payloads.
+// The caller must close the response body. Responses of every status code are returned without error.
+// The body is not limited by MaxResponseSize but by WithMaxResponseSize of the request context.
+// TimeoutSeconds of the client only limits the time until the response headers are received,
+// reading the body is bounded by the context of the request.
+func (c *HttpClient) DoStream(req *http.Request) (*http.Response, error) {
+	client := c.getClient()
+	streamClient := *client
+	streamClient.Timeout = 0
+	ctx, cancel := context.WithCancel(req.Context())
+	var timer *time.Timer
+	if client.Timeout > 0 {
+		timer = time.AfterFunc(client.Timeout, cancel)
+	}
+	res, err := c.do(&streamClient, req.WithContext(ctx))
+	if timer != nil && !timer.Stop() {
+		// the timer has canceled the request
+		if err == nil {
+			res.Body.Close()
+		}
+		err = newTransportError(req, fmt.Errorf("%w (Timeout exceeded while awaiting headers)", context.DeadlineExceeded))
+	}
+	if err != nil {
+		cancel()
+		c.closeIdleConnections(client)
+		return nil, err
+	}
+	body := res.Body
+	if limit, ok := req.Context().Value(maxResponseSizeKey{}).(int64); ok && limit > 0 {
+		body = &limitedBody{ReadCloser: body, res: res, limit: limit}
+	}
+	res.Body = &streamBody{ReadCloser: body, onClose: func() {
+		cancel()
+		c.closeIdleConnections(client)
+	}}
+	return res, nil
+}
+
+func (c *HttpClient) SendStreamRequest(method, url string, body io.Reader, header map[string]string) (int, io.ReadCloser, error) {
+	return c.SendStreamRequestWithContext(context.Background(), method, url, body, header)
+}
+
+// SendStreamRequestWithContext send the request with body, which can be nil, and return the response body
+// without reading it, the caller must close it. See DoStream for the limits of the body.
+func (c *HttpClient) SendStreamRequestWithContext(ctx context.Context, method, url string, body io.Reader, header map[string]string) (int, io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		c.getLogger().Error("SendStreamRequest http client new request error", "url", url, "error", err)
+		return 0, nil, newRequestError(method, url, err)
+	}
+	setHeader(req, header)
+	res, err := c.DoStream(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	return res.StatusCode, res.Body, nil
+}
@@ -0,0 +1,212 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy define when and how HttpClient send a request again
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts include the first one, less than 2 means never retry
+	MaxAttempts int
+	// InitialBackoff is the wait time before the second attempt
+	InitialBackoff time.Duration
+	// MaxBackoff is the upper bound of the wait time between attempts
+	MaxBackoff time.Duration
+	// Multiplier grows the backoff after each attempt
+	Multiplier float64
+	// Jitter randomizes the backoff by ± ratio, must be between 0 and 1
+	Jitter float64
+	// RetryStatusCodes are the response status codes which should be retried
+	RetryStatusCodes []int
+	// RetryNonIdempotent allow retrying methods like POST and PATCH
+	RetryNonIdempotent bool
+	// IgnoreRetryAfter use the backoff even if the response has Retry-After header
+	IgnoreRetryAfter bool
+	// MaxRetryAfter stop retrying when Retry-After asks to wait longer than it, 0 means no limit
+	MaxRetryAfter time.Duration
+}
+
+// DefaultRetryPolicy retry idempotent requests 3 times in total on transient transport errors, e.g. timeouts and reset connections, and on 429, 502, 503, 504
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:      3,
+		InitialBackoff:   500 * time.Millisecond,
+		MaxBackoff:       10 * time.Second,
+		Multiplier:       2,
+		Jitter:           0.2,
+		RetryStatusCodes: []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+	}
+}
+
+type retryPolicyKey struct{}
+
+// WithRetryPolicy override the retry policy of HttpClient for requests sent with the returned context,
+// a nil policy disable retrying
+func WithRetryPolicy(ctx context.Context, policy *RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryPolicyKey{}, policy)
+}
+
+func (c *HttpClient) retryPolicy(ctx context.Context) *RetryPolicy {
+	if policy, ok := ctx.Value(retryPolicyKey{}).(*RetryPolicy); ok {
+		return policy
+	}
+	return c.RetryPolicy
+}
+
+func (p *RetryPolicy) maxAttempts(req *http.Request) int {
+	if p == nil || p.MaxAttempts < 2 {
+		return 1
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		// body can not be replayed
+		return 1
+	}
+	if !p.RetryNonIdempotent && !isIdempotent(req) {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != "" || req.Header.Get("X-Idempotency-Key") != ""
+}
+
+func (p *RetryPolicy) shouldRetry(ctx context.Context, res *http.Response, err error, s *sent) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		// the errors of the middlewares and the other failures of the network happen again
+		return s.byNetwork(err) && isTransientError(err)
+	}
+	for _, code := range p.RetryStatusCodes {
+		if res.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransientError report whether a failure of the network may not happen again, i.e. a timeout,
+// a reset or refused connection, or a connection closed before the whole response is received
+func isTransientError(err error) bool {
+	if (&TransportError{Err: err}).TLS() {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// backoff return the wait time before the next attempt, false means the server asks to wait too long
+func (p *RetryPolicy) backoff(attempt int, res *http.Response) (time.Duration, bool) {
+	if res != nil && !p.IgnoreRetryAfter {
+		if wait, ok := parseRetryAfter(res.Header.Get("Retry-After")); ok {
+			if p.MaxRetryAfter > 0 && wait > p.MaxRetryAfter {
+				return 0, false
+			}
+			return wait, true
+		}
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	wait := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && wait > float64(p.MaxBackoff) {
+		wait = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		wait = wait * (1 - p.Jitter + 2*p.Jitter*rand.Float64())
+	}
+	return time.Duration(wait), true
+}
+
+// parseRetryAfter parse Retry-After header in delay-seconds or HTTP-date format
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		wait := time.Until(t)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
+
+// do send the request with the retry policy, the request body is rebuilt by req.GetBody before each retry,
+// an error is returned as TransportError or MiddlewareError, and res.Request is set when a middleware left it nil
+func (c *HttpClient) do(client *http.Client, req *http.Request) (*http.Response, error) {
+	req, s := withSent(req)
+	res, err := c.doWithRetry(client, req, s)
+	if err != nil {
+		return nil, newSendError(req, s, err)
+	}
+	if res.Request == nil {
+		res.Request = req
+	}
+	return res, nil
+}
+
+func (c *HttpClient) doWithRetry(client *http.Client, req *http.Request, s *sent) (*http.Response, error) {
+	ctx := req.Context()
+	policy := c.retryPolicy(ctx)
+	attempts := policy.maxAttempts(req)
+	attemptReq := req
+	for attempt := 1; ; attempt++ {
+		res, err := client.Do(attemptReq)
+		if attempt >= attempts || !policy.shouldRetry(ctx, res, err, s) {
+			return res, err
+		}
+		wait, ok := policy.backoff(attempt, res)
+		if !ok {
+			return res, err
+		}
+		if res != nil {
+			// drain a little so the connection can be reused
+			io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096))
+			res.Body.Close()
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		attemptReq = req.Clone(ctx)
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq.Body = body
+		}
+	}
+}
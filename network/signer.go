@@ -0,0 +1,211 @@
+package network
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidSignature is returned by VerifyHMACRequest when the signature is missing or does not match
+	ErrInvalidSignature = errors.New("invalid request signature")
+	// ErrSignatureExpired is returned by VerifyHMACRequest when the timestamp is out of the allowed skew
+	ErrSignatureExpired = errors.New("request signature timestamp is out of range")
+)
+
+// Signer sign the requests of HttpClient right before they are sent, after every middleware.
+// req is a copy which can be modified, its body can be read again by req.GetBody when it has one.
+type Signer interface {
+	Sign(req *http.Request) error
+}
+
+// HMACSigner sign requests by HMAC-SHA256 of the canonical request, which is the lines of
+// method, escaped path, sorted query, timestamp, nonce, signed headers as "name:value", and hex SHA-256 of the body
+type HMACSigner struct {
+	// KeyID is sent in KeyIDHeader to tell the server which secret is used, it is not sent when empty
+	KeyID  string
+	Secret []byte
+	// SignedHeaders are the names of extra headers to sign, "host" signs the host of the request
+	SignedHeaders []string
+	// SignatureHeader default is X-Signature, its value is the hex HMAC-SHA256
+	SignatureHeader string
+	// TimestampHeader default is X-Timestamp, its value is the unix time in seconds
+	TimestampHeader string
+	// NonceHeader default is X-Nonce
+	NonceHeader string
+	// KeyIDHeader default is X-Key-Id
+	KeyIDHeader string
+}
+
+// NewHMACSigner create a HMAC-SHA256 signer with the default header names
+func NewHMACSigner(keyID string, secret []byte) *HMACSigner {
+	return &HMACSigner{KeyID: keyID, Secret: secret}
+}
+
+func (s *HMACSigner) header(name, defaultName string) string {
+	if name == "" {
+		return defaultName
+	}
+	return name
+}
+
+// Sign implements Signer
+func (s *HMACSigner) Sign(req *http.Request) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	req.Header.Set(s.header(s.TimestampHeader, "X-Timestamp"), strconv.FormatInt(time.Now().Unix(), 10))
+	req.Header.Set(s.header(s.NonceHeader, "X-Nonce"), hex.EncodeToString(nonce))
+	if s.KeyID != "" {
+		req.Header.Set(s.header(s.KeyIDHeader, "X-Key-Id"), s.KeyID)
+	}
+	var body io.ReadCloser
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return errors.New("request body can not be read again to sign")
+		}
+		var err error
+		if body, err = req.GetBody(); err != nil {
+			return err
+		}
+		defer body.Close()
+	}
+	signature, err := s.signature(req, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(s.header(s.SignatureHeader, "X-Signature"), signature)
+	return nil
+}
+
+// signature return the hex HMAC-SHA256 of the canonical request, body can be nil
+func (s *HMACSigner) signature(req *http.Request, body io.Reader) (string, error) {
+	bodyHash := sha256.New()
+	if body != nil {
+		if _, err := io.Copy(bodyHash, body); err != nil {
+			return "", err
+		}
+	}
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	lines := []string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		req.Header.Get(s.header(s.TimestampHeader, "X-Timestamp")),
+		req.Header.Get(s.header(s.NonceHeader, "X-Nonce")),
+	}
+	for _, name := range s.SignedHeaders {
+		name = strings.ToLower(name)
+		value := strings.Join(req.Header.Values(name), ",")
+		if name == "host" {
+			value = req.Host
+			if value == "" {
+				value = req.URL.Host
+			}
+		}
+		lines = append(lines, name+":"+strings.TrimSpace(value))
+	}
+	lines = append(lines, hex.EncodeToString(bodyHash.Sum(nil)))
+	mac := hmac.New(sha256.New, s.Secret)
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func canonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		vs := append([]string(nil), values[key]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			pairs = append(pairs, url.QueryEscape(key)+"="+url.QueryEscape(v))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// VerifyHMACRequest verify the signature of an incoming request signed by the same HMACSigner settings,
+// the timestamp must be within maxSkew of now, default is 5 minutes. The body is read and put back so the
+// handler can still read it. Rejecting a reused nonce is left to the caller.
+func VerifyHMACRequest(req *http.Request, signer *HMACSigner, maxSkew time.Duration) error {
+	if maxSkew <= 0 {
+		maxSkew = 5 * time.Minute
+	}
+	signature := req.Header.Get(signer.header(signer.SignatureHeader, "X-Signature"))
+	if signature == "" {
+		return ErrInvalidSignature
+	}
+	timestamp, err := strconv.ParseInt(req.Header.Get(signer.header(signer.TimestampHeader, "X-Timestamp")), 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if skew := time.Since(time.Unix(timestamp, 0)); skew > maxSkew || skew < -maxSkew {
+		return ErrSignatureExpired
+	}
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+	}
+	expected, err := signer.signature(req, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// signerMiddleware sign a copy of the request by Signer, the body is buffered when it can not be read again.
+// Redirects to another host are not signed.
+func (c *HttpClient) signerMiddleware(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		signer := c.Signer
+		if signer == nil || isCrossHostRedirect(req) {
+			return next.RoundTrip(req)
+		}
+		signed := req.Clone(req.Context())
+		if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			body, err := ioutil.ReadAll(req.Body)
+			req.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			signed.Body = ioutil.NopCloser(bytes.NewReader(body))
+			signed.GetBody = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(bytes.NewReader(body)), nil
+			}
+		}
+		if err := signer.Sign(signed); err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, err
+		}
+		return next.RoundTrip(signed)
+	})
+}
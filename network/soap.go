@@ -0,0 +1,242 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// SoapVersion is the version of SOAP envelope
+type SoapVersion int
+
+const (
+	Soap11 SoapVersion = iota
+	Soap12
+)
+
+const (
+	soap11Namespace = "http://schemas.xmlsoap.org/soap/envelope/"
+	soap12Namespace = "http://www.w3.org/2003/05/soap-envelope"
+)
+
+func (v SoapVersion) namespace() string {
+	if v == Soap12 {
+		return soap12Namespace
+	}
+	return soap11Namespace
+}
+
+// contentType return the Content-Type of the version, the action is a parameter of it in SOAP 1.2
+func (v SoapVersion) contentType(action string) string {
+	if v == Soap12 {
+		if action == "" {
+			return "application/soap+xml; charset=utf-8"
+		}
+		return fmt.Sprintf("application/soap+xml; charset=utf-8; action=%q", action)
+	}
+	return "text/xml; charset=utf-8"
+}
+
+// SoapRequest is a SOAP call sent by CallSoap
+type SoapRequest struct {
+	Version SoapVersion
+	// Action is sent in SOAPAction header in SOAP 1.1 and in the action parameter of Content-Type in SOAP 1.2
+	Action string
+	// Headers are the header blocks of the envelope
+	Headers []interface{}
+	// Body is the content of the Body of the envelope
+	Body interface{}
+}
+
+// SoapFault is the Fault in the Body of a SOAP response
+type SoapFault struct {
+	StatusCode int
+	// Code is faultcode in SOAP 1.1 or Code/Value in SOAP 1.2
+	Code string
+	// Subcode is Code/Subcode/Value in SOAP 1.2
+	Subcode string
+	// String is faultstring in SOAP 1.1 or Reason/Text in SOAP 1.2
+	String string
+	// Actor is faultactor in SOAP 1.1 or Role in SOAP 1.2
+	Actor string
+	// Detail is the raw xml inside detail in SOAP 1.1 or Detail in SOAP 1.2
+	Detail []byte
+}
+
+func (f *SoapFault) Error() string {
+	return fmt.Sprintf("soap fault (status code %d): %s %s", f.StatusCode, f.Code, f.String)
+}
+
+// BuildSoapEnvelope marshal headers and body into a SOAP envelope, each of them is inserted as raw xml
+// when it is a string or []byte, and marshaled by encoding/xml otherwise
+func BuildSoapEnvelope(version SoapVersion, headers []interface{}, body interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<soap:Envelope xmlns:soap="` + version.namespace() + `">`)
+	if len(headers) > 0 {
+		buf.WriteString("<soap:Header>")
+		for _, header := range headers {
+			if err := writeSoapBlock(&buf, header); err != nil {
+				return nil, err
+			}
+		}
+		buf.WriteString("</soap:Header>")
+	}
+	buf.WriteString("<soap:Body>")
+	if err := writeSoapBlock(&buf, body); err != nil {
+		return nil, err
+	}
+	buf.WriteString("</soap:Body></soap:Envelope>")
+	return buf.Bytes(), nil
+}
+
+func writeSoapBlock(buf *bytes.Buffer, block interface{}) error {
+	switch v := block.(type) {
+	case nil:
+	case string:
+		buf.WriteString(v)
+	case []byte:
+		buf.Write(v)
+	default:
+		data, err := xml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+	}
+	return nil
+}
+
+type soapEnvelope struct {
+	Body struct {
+		Content []byte `xml:",innerxml"`
+	} `xml:"Body"`
+}
+
+type soapFaultXML struct {
+	FaultCode   string `xml:"faultcode"`
+	FaultString string `xml:"faultstring"`
+	FaultActor  string `xml:"faultactor"`
+	Detail11    struct {
+		Content []byte `xml:",innerxml"`
+	} `xml:"detail"`
+	Code struct {
+		Value   string `xml:"Value"`
+		Subcode struct {
+			Value string `xml:"Value"`
+		} `xml:"Subcode"`
+	} `xml:"Code"`
+	Reason struct {
+		Text []string `xml:"Text"`
+	} `xml:"Reason"`
+	Role     string `xml:"Role"`
+	Detail12 struct {
+		Content []byte `xml:",innerxml"`
+	} `xml:"Detail"`
+}
+
+// ParseSoapResponse unmarshal the first element in the Body of a SOAP envelope into out,
+// a Fault is returned as *SoapFault. The body is not unmarshaled when out is nil.
+func ParseSoapResponse(statusCode int, data []byte, out interface{}) error {
+	var envelope soapEnvelope
+	if err := xml.Unmarshal(data, &envelope); err != nil {
+		return &DecodeError{StatusCode: statusCode, Body: data, Err: err}
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(envelope.Body.Content))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &DecodeError{StatusCode: statusCode, Body: data, Err: err}
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if start.Name.Local == "Fault" {
+			var fault soapFaultXML
+			if err := decoder.DecodeElement(&fault, &start); err != nil {
+				return &DecodeError{StatusCode: statusCode, Body: data, Err: err}
+			}
+			return fault.soapFault(statusCode)
+		}
+		if out == nil {
+			return nil
+		}
+		if err := decoder.DecodeElement(out, &start); err != nil {
+			return &DecodeError{StatusCode: statusCode, Body: data, Err: err}
+		}
+		return nil
+	}
+}
+
+func (f *soapFaultXML) soapFault(statusCode int) *SoapFault {
+	fault := &SoapFault{
+		StatusCode: statusCode,
+		Code:       strings.TrimSpace(f.FaultCode),
+		String:     strings.TrimSpace(f.FaultString),
+		Actor:      strings.TrimSpace(f.FaultActor),
+		Detail:     bytes.TrimSpace(f.Detail11.Content),
+	}
+	if fault.Code == "" {
+		fault.Code = strings.TrimSpace(f.Code.Value)
+		fault.Subcode = strings.TrimSpace(f.Code.Subcode.Value)
+	}
+	if fault.String == "" && len(f.Reason.Text) > 0 {
+		fault.String = strings.TrimSpace(f.Reason.Text[0])
+	}
+	if fault.Actor == "" {
+		fault.Actor = strings.TrimSpace(f.Role)
+	}
+	if len(fault.Detail) == 0 {
+		fault.Detail = bytes.TrimSpace(f.Detail12.Content)
+	}
+	return fault
+}
+
+// CallSoap wrap soapReq into an envelope and post it, the first element in the Body of the response
+// is unmarshaled into out and a Fault is returned as *SoapFault
+func (c *HttpClient) CallSoap(url string, soapReq *SoapRequest, out interface{}, header map[string]string) (int, error) {
+	return c.CallSoapWithContext(context.Background(), url, soapReq, out, header)
+}
+
+// CallSoapWithContext is CallSoap whose request is aborted when ctx is done
+func (c *HttpClient) CallSoapWithContext(ctx context.Context, url string, soapReq *SoapRequest, out interface{}, header map[string]string) (int, error) {
+	if soapReq == nil {
+		return 0, newRequestError(http.MethodPost, url, errors.New("soap request is nil"))
+	}
+	payload, err := BuildSoapEnvelope(soapReq.Version, soapReq.Headers, soapReq.Body)
+	if err != nil {
+		c.getLogger().Error("CallSoap build envelope error", "url", url, "error", err)
+		return 0, newRequestError(http.MethodPost, url, err)
+	}
+	req, err := c.newSoapRequest(ctx, http.MethodPost, url, payload)
+	if err != nil {
+		c.getLogger().Error("CallSoap http new request error", "url", url, "error", err)
+		return 0, newRequestError(http.MethodPost, url, err)
+	}
+	req.Header.Set("Content-Type", soapReq.Version.contentType(soapReq.Action))
+	if soapReq.Version != Soap12 {
+		req.Header.Set("SOAPAction", fmt.Sprintf("%q", soapReq.Action))
+	}
+	setHeader(req, header)
+	client := c.getClient()
+	res, err := c.do(client, req)
+	defer c.closeIdleConnections(client)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	body, err := c.readBody(res)
+	if err != nil {
+		return res.StatusCode, err
+	}
+	return res.StatusCode, ParseSoapResponse(res.StatusCode, body, out)
+}
@@ -0,0 +1,166 @@
+package network
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// ErrCertificatePinMismatch is returned when no certificate of the server matches the pinned public keys
+var ErrCertificatePinMismatch = errors.New("server certificate does not match any pinned public key")
+
+// TLSConfig configure the TLS connections of HttpClient
+type TLSConfig struct {
+	// CAFiles are PEM bundles of extra trusted CAs
+	CAFiles []string
+	// CAPEM is a PEM bundle of extra trusted CAs
+	CAPEM []byte
+	// DisableSystemRoots trust only the CAs above instead of adding them to the system roots
+	DisableSystemRoots bool
+	// CertFile and KeyFile are the PEM client certificate and key presented for mutual TLS
+	CertFile string
+	KeyFile  string
+	// Certificates are client certificates presented for mutual TLS along with CertFile
+	Certificates []tls.Certificate
+	// PinnedSPKISHA256 are base64 SHA-256 hashes of the SubjectPublicKeyInfo, optionally prefixed by "sha256/",
+	// the connection fails unless a certificate in the chain of the server matches one of them
+	PinnedSPKISHA256 []string
+	// MinVersion is the minimum TLS version like tls.VersionTLS12, 0 means TLS 1.2
+	MinVersion uint16
+	// MaxVersion is the maximum TLS version, 0 means the highest supported
+	MaxVersion uint16
+	// CipherSuites are the enabled cipher suites of TLS 1.2 and below, empty means the defaults of crypto/tls
+	CipherSuites []uint16
+	// ServerName override the host name used to verify the certificate of the server
+	ServerName string
+}
+
+// SPKIHash return the base64 SHA-256 hash of the SubjectPublicKeyInfo of cert, which can be pinned by TLSConfig
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func (cfg *TLSConfig) build() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:   cfg.MinVersion,
+		MaxVersion:   cfg.MaxVersion,
+		CipherSuites: append([]uint16(nil), cfg.CipherSuites...),
+		ServerName:   cfg.ServerName,
+		Certificates: append([]tls.Certificate(nil), cfg.Certificates...),
+	}
+	if tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+	if len(cfg.CAFiles) > 0 || len(cfg.CAPEM) > 0 || cfg.DisableSystemRoots {
+		pool := x509.NewCertPool()
+		if !cfg.DisableSystemRoots {
+			if systemPool, err := x509.SystemCertPool(); err == nil && systemPool != nil {
+				pool = systemPool
+			}
+		}
+		for _, path := range cfg.CAFiles {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificate found in CA file %s", path)
+			}
+		}
+		if len(cfg.CAPEM) > 0 && !pool.AppendCertsFromPEM(cfg.CAPEM) {
+			return nil, errors.New("no certificate found in CAPEM")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
+	if len(cfg.PinnedSPKISHA256) > 0 {
+		pins := make(map[string]bool)
+		for _, pin := range cfg.PinnedSPKISHA256 {
+			pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+			if sum, err := base64.StdEncoding.DecodeString(pin); err != nil || len(sum) != sha256.Size {
+				return nil, fmt.Errorf("invalid SPKI pin %q, must be a base64 SHA-256 hash", pin)
+			}
+			pins[pin] = true
+		}
+		tlsConfig.VerifyPeerCertificate = verifyPins(pins)
+	}
+	return tlsConfig, nil
+}
+
+// verifyPins check the verified chains, or the certificates sent by the server when verification is skipped
+func verifyPins(pins map[string]bool) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if pins[SPKIHash(cert)] {
+					return nil
+				}
+			}
+		}
+		if len(verifiedChains) == 0 {
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err == nil && pins[SPKIHash(cert)] {
+					return nil
+				}
+			}
+		}
+		return ErrCertificatePinMismatch
+	}
+}
+
+// SetTLSConfig set the TLS config of the client, a nil config means verifying with the system roots over TLS 1.2 or higher.
+// The certificate of the server is still not verified if InsecureSkipVerify is true.
+func (c *HttpClient) SetTLSConfig(cfg *TLSConfig) error {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg != nil {
+		var err error
+		if tlsConfig, err = cfg.build(); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tlsConfig = tlsConfig
+	old := c.client
+	c.client = c.newClient()
+	old.CloseIdleConnections()
+	return nil
+}
+
+// clientTLSConfig must be called with c.mu held or before the client is shared
+func (c *HttpClient) clientTLSConfig() *tls.Config {
+	var tlsConfig *tls.Config
+	if c.tlsConfig != nil {
+		tlsConfig = c.tlsConfig.Clone()
+	} else {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	tlsConfig.InsecureSkipVerify = c.InsecureSkipVerify
+	if c.InsecureSkipVerify {
+		tlsConfig.VerifyConnection = c.warnInsecure
+	}
+	return tlsConfig
+}
+
+// warnInsecure is called on the TLS handshakes without certificate verification, it warns once per client
+// on the first handshake, so the warning reaches the logger set after the client is created
+func (c *HttpClient) warnInsecure(state tls.ConnectionState) error {
+	c.insecureOnce.Do(func() {
+		c.getLogger().Warn("tls certificate verification is disabled, connections are open to man-in-the-middle attacks",
+			"server_name", state.ServerName)
+	})
+	return nil
+}
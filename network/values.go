@@ -0,0 +1,254 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ToValues convert params to url.Values, params can be url.Values, map[string][]string, map[string]string,
+// or a struct (or pointer to struct) whose fields are tagged like `url:"name,omitempty"`.
+// Slice fields become repeated keys, a field tagged `url:"-"` is skipped.
+func ToValues(params interface{}) (url.Values, error) {
+	values := url.Values{}
+	switch p := params.(type) {
+	case nil:
+		return values, nil
+	case url.Values:
+		for key, vals := range p {
+			values[key] = append([]string(nil), vals...)
+		}
+		return values, nil
+	case map[string][]string:
+		for key, vals := range p {
+			values[key] = append([]string(nil), vals...)
+		}
+		return values, nil
+	case map[string]string:
+		for key, val := range p {
+			values.Set(key, val)
+		}
+		return values, nil
+	}
+	v := reflect.ValueOf(params)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return values, nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("can not convert %T to url values", params)
+	}
+	if err := structValues(values, v); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func structValues(values url.Values, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fv := v.Field(i)
+		tag := field.Tag.Get("url")
+		if tag == "-" || (field.PkgPath != "" && !field.Anonymous) {
+			continue
+		}
+		name, opts := tag, ""
+		if comma := strings.Index(tag, ","); comma >= 0 {
+			name, opts = tag[:comma], tag[comma+1:]
+		}
+		omitempty := strings.Contains(opts, "omitempty")
+		for fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				break
+			}
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.Ptr {
+			// nil pointer
+			continue
+		}
+		if field.Anonymous && name == "" && fv.Kind() == reflect.Struct {
+			if err := structValues(values, fv); err != nil {
+				return err
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if omitempty && isEmptyValue(fv) {
+			continue
+		}
+		if (fv.Kind() == reflect.Slice || fv.Kind() == reflect.Array) && fv.Type().Elem().Kind() != reflect.Uint8 {
+			for j := 0; j < fv.Len(); j++ {
+				s, err := valueString(fv.Index(j))
+				if err != nil {
+					return fmt.Errorf("url value %s: %v", name, err)
+				}
+				values.Add(name, s)
+			}
+			continue
+		}
+		s, err := valueString(fv)
+		if err != nil {
+			return fmt.Errorf("url value %s: %v", name, err)
+		}
+		values.Add(name, s)
+	}
+	return nil
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	case reflect.Struct:
+		if t, ok := v.Interface().(time.Time); ok {
+			return t.IsZero()
+		}
+	}
+	return false
+}
+
+func valueString(v reflect.Value) (string, error) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return "", nil
+		}
+		v = v.Elem()
+	}
+	if v.CanInterface() {
+		switch vv := v.Interface().(type) {
+		case time.Time:
+			return vv.Format(time.RFC3339), nil
+		case fmt.Stringer:
+			return vv.String(), nil
+		case []byte:
+			return string(vv), nil
+		}
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 32), nil
+	case reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64), nil
+	}
+	return "", fmt.Errorf("unsupported type %s", v.Type())
+}
+
+// AppendQuery merge values into the query string of rawURL, the query is encoded in key order
+// so the same params always produce the same url
+func AppendQuery(rawURL string, values url.Values) (string, error) {
+	if len(values) == 0 {
+		return rawURL, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return "", err
+	}
+	for key, vals := range values {
+		query[key] = append(query[key], vals...)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func (c *HttpClient) SendQueryValuesRequest(method, url string, params interface{}, header map[string]string) (int, map[string]interface{}, error) {
+	return c.SendQueryValuesRequestWithContext(context.Background(), method, url, params, header)
+}
+
+// SendQueryValuesRequestWithContext send request whose query string is built from params,
+// params can be anything accepted by ToValues and is merged with the query already in url
+func (c *HttpClient) SendQueryValuesRequestWithContext(ctx context.Context, method, url string, params interface{}, header map[string]string) (int, map[string]interface{}, error) {
+	values, err := ToValues(params)
+	if err != nil {
+		c.getLogger().Error("SendQueryRequest convert params error", "url", url, "error", err)
+		return 0, nil, newRequestError(method, url, err)
+	}
+	reqURL, err := AppendQuery(url, values)
+	if err != nil {
+		c.getLogger().Error("SendQueryRequest build url error", "url", url, "error", err)
+		return 0, nil, newRequestError(method, url, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, reqURL, nil)
+	if err != nil {
+		c.getLogger().Error("SendQueryRequest http client new request error", "url", url, "error", err)
+		return 0, nil, newRequestError(method, url, err)
+	}
+	setHeader(req, header)
+	client := c.getClient()
+	res, err := c.do(client, req)
+	defer c.closeIdleConnections(client)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	return c.extractBody(res)
+}
+
+func (c *HttpClient) SendURLEncodedFormRequest(method, url string, params interface{}, header map[string]string) (int, map[string]interface{}, error) {
+	return c.SendURLEncodedFormRequestWithContext(context.Background(), method, url, params, header)
+}
+
+// SendURLEncodedFormRequestWithContext send application/x-www-form-urlencoded request,
+// params can be anything accepted by ToValues, use url.Values or map[string][]string for repeated fields
+func (c *HttpClient) SendURLEncodedFormRequestWithContext(ctx context.Context, method, url string, params interface{}, header map[string]string) (int, map[string]interface{}, error) {
+	values, err := ToValues(params)
+	if err != nil {
+		c.getLogger().Error("SendURLEncodedFormRequest convert params error", "url", url, "error", err)
+		return 0, nil, newRequestError(method, url, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(values.Encode()))
+	if err != nil {
+		c.getLogger().Error("SendURLEncodedFormRequest http client new request error", "url", url, "error", err)
+		return 0, nil, newRequestError(method, url, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	setHeader(req, header)
+	client := c.getClient()
+	res, err := c.do(client, req)
+	defer c.closeIdleConnections(client)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	return c.extractBody(res)
+}
+
+func (c *HttpClient) PostURLEncodedFormRequest(url string, params interface{}, header map[string]string) (int, map[string]interface{}, error) {
+	return c.SendURLEncodedFormRequest("POST", url, params, header)
+}
+
+func (c *HttpClient) GetQueryValuesRequest(url string, params interface{}, header map[string]string) (int, map[string]interface{}, error) {
+	return c.SendQueryValuesRequest("GET", url, params, header)
+}
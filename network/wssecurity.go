@@ -0,0 +1,193 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	wsseNamespace      = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-secext-1.0.xsd"
+	wsuNamespace       = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-wssecurity-utility-1.0.xsd"
+	wssPasswordDigest  = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0#PasswordDigest"
+	wssPasswordText    = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-username-token-profile-1.0#PasswordText"
+	wssBase64Binary    = "http://docs.oasis-open.org/wss/2004/01/oasis-200401-wss-soap-message-security-1.0#Base64Binary"
+	wssTimestampLayout = "2006-01-02T15:04:05.000Z"
+)
+
+// WSSecurity add a WS-Security header with a UsernameToken and a Timestamp to the SOAP envelopes sent by HttpClient,
+// a new nonce and timestamp are generated for every attempt of a request, retries included
+type WSSecurity struct {
+	Username string
+	Password string
+	// PasswordText send the password as is instead of PasswordDigest
+	PasswordText bool
+	// TTL is the time from Created to Expires of the Timestamp, default is 5 minutes, negative means no Timestamp
+	TTL time.Duration
+}
+
+// WSSecurityPasswordDigest return Base64(SHA-1(nonce + created + password)) of a UsernameToken
+func WSSecurityPasswordDigest(nonce []byte, created, password string) string {
+	h := sha1.New()
+	h.Write(nonce)
+	h.Write([]byte(created))
+	h.Write([]byte(password))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// header return the Security header block, envelopeNamespace is used for the mustUnderstand attribute
+func (s *WSSecurity) header(envelopeNamespace string) ([]byte, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	created := now.Format(wssTimestampLayout)
+	var buf bytes.Buffer
+	buf.WriteString(`<wsse:Security xmlns:wsse="` + wsseNamespace + `" xmlns:wsu="` + wsuNamespace +
+		`" xmlns:env="` + envelopeNamespace + `" env:mustUnderstand="1">`)
+	ttl := s.TTL
+	if ttl == 0 {
+		ttl = 5 * time.Minute
+	}
+	if ttl > 0 {
+		buf.WriteString(`<wsu:Timestamp><wsu:Created>` + created + `</wsu:Created><wsu:Expires>` +
+			now.Add(ttl).Format(wssTimestampLayout) + `</wsu:Expires></wsu:Timestamp>`)
+	}
+	buf.WriteString(`<wsse:UsernameToken><wsse:Username>`)
+	xml.EscapeText(&buf, []byte(s.Username))
+	buf.WriteString(`</wsse:Username>`)
+	if s.PasswordText {
+		buf.WriteString(`<wsse:Password Type="` + wssPasswordText + `">`)
+		xml.EscapeText(&buf, []byte(s.Password))
+	} else {
+		buf.WriteString(`<wsse:Password Type="` + wssPasswordDigest + `">` + WSSecurityPasswordDigest(nonce, created, s.Password))
+	}
+	buf.WriteString(`</wsse:Password><wsse:Nonce EncodingType="` + wssBase64Binary + `">` +
+		base64.StdEncoding.EncodeToString(nonce) + `</wsse:Nonce><wsu:Created>` + created +
+		`</wsu:Created></wsse:UsernameToken></wsse:Security>`)
+	return buf.Bytes(), nil
+}
+
+// Apply insert the Security header block into the Header of a SOAP 1.1 or 1.2 envelope,
+// the Header is created when the envelope has none
+func (s *WSSecurity) Apply(envelope []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(envelope))
+	depth := 0
+	namespace := ""
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil, errors.New("soap envelope has no Body")
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 1 {
+				if t.Name.Local != "Envelope" {
+					return nil, errors.New("payload is not a soap envelope")
+				}
+				namespace = t.Name.Space
+				continue
+			}
+			if depth != 2 || (t.Name.Local != "Header" && t.Name.Local != "Body") {
+				continue
+			}
+			security, err := s.header(namespace)
+			if err != nil {
+				return nil, err
+			}
+			end := decoder.InputOffset()
+			startTag := envelope[offset:end]
+			prefix := soapPrefix(startTag, t.Name.Local)
+			var buf bytes.Buffer
+			buf.Grow(len(envelope) + len(security) + 32)
+			switch {
+			case t.Name.Local == "Header" && bytes.HasSuffix(startTag, []byte("/>")):
+				buf.Write(envelope[:offset])
+				buf.Write(startTag[:len(startTag)-2])
+				buf.WriteString(">")
+				buf.Write(security)
+				buf.WriteString("</" + prefix + "Header>")
+			case t.Name.Local == "Header":
+				buf.Write(envelope[:end])
+				buf.Write(security)
+			default:
+				buf.Write(envelope[:offset])
+				buf.WriteString("<" + prefix + "Header>")
+				buf.Write(security)
+				buf.WriteString("</" + prefix + "Header>")
+				buf.Write(startTag)
+			}
+			buf.Write(envelope[end:])
+			return buf.Bytes(), nil
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+// soapPrefix return the prefix with colon of the element name in the raw start tag, e.g. "soap:"
+func soapPrefix(startTag []byte, local string) string {
+	i := bytes.Index(startTag, []byte(local))
+	if i <= 1 {
+		return ""
+	}
+	return string(startTag[1:i])
+}
+
+// soapPayloadKey keep the soap envelope without WS-Security header in the request context,
+// so wsSecurityMiddleware can add a new header to every attempt
+type soapPayloadKey struct{}
+
+// newSoapRequest create a request of the soap envelope, the WS-Security header of the client
+// is added by wsSecurityMiddleware when the request is sent
+func (c *HttpClient) newSoapRequest(ctx context.Context, method, url string, payload []byte) (*http.Request, error) {
+	if c.WSSecurity != nil {
+		// fail before sending when the payload is not an envelope
+		if _, err := c.WSSecurity.Apply(payload); err != nil {
+			return nil, err
+		}
+		ctx = context.WithValue(ctx, soapPayloadKey{}, payload)
+	}
+	return http.NewRequestWithContext(ctx, method, url, bytes.NewReader(payload))
+}
+
+// wsSecurityMiddleware add the WS-Security header to the envelope of every attempt, so retries are not
+// rejected as replays. It runs before compressionMiddleware and signerMiddleware, which see the final envelope.
+// Redirects to another host get the envelope without the header.
+func (c *HttpClient) wsSecurityMiddleware(next http.RoundTripper) http.RoundTripper {
+	return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		wss := c.WSSecurity
+		payload, ok := req.Context().Value(soapPayloadKey{}).([]byte)
+		if wss == nil || !ok || isCrossHostRedirect(req) {
+			return next.RoundTrip(req)
+		}
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		secured, err := wss.Apply(payload)
+		if err != nil {
+			return nil, err
+		}
+		out := req.Clone(req.Context())
+		out.Body = ioutil.NopCloser(bytes.NewReader(secured))
+		out.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(secured)), nil
+		}
+		out.ContentLength = int64(len(secured))
+		return next.RoundTrip(out)
+	})
+}
@@ -1,7 +1,6 @@
 package goutil
 
 import (
-	"log"
 	"strconv"
 	"strings"
 )
@@ -157,7 +156,7 @@ func CreateResponseDesc(key, param, desc string) map[string]interface{} {
 		}
 	} else {
 		errMsg := setMessage(ErrorCodeTable[key][1], param)
-		log.Println("error message: ", code, errMsg)
+		getLogger().Info("error message", "code", code, "message", errMsg)
 		if desc == "" {
 			desc = setMessage(ErrorCodeTable[key][2], param)
 		}
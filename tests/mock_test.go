@@ -0,0 +1,95 @@
+package test_tests
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/NovanHsiu/goutil/network"
+	"github.com/NovanHsiu/goutil/network/mock"
+)
+
+func TestMockServer(t *testing.T) {
+	server := mock.NewServer()
+	defer server.Close()
+	server.On("GET", "/patients").WithQuery("id", "1").RespondJSON(200, map[string]interface{}{"name": "Alice"})
+	server.On("POST", "/patients").WithHeader("X-Api-Key", "key").WithJSONBody(`{"name":"Bob","age":30}`).RespondJSON(201, `{"id":2}`)
+	server.On("POST", "/soap/*").RespondSoap(200, "<AddResponse><result>3</result></AddResponse>")
+	server.On("POST", "/soap/fault").RespondSoapFault("soap:Server", "database is down")
+	server.On("GET", "/files/run_test.sh").RespondFile(200, "run_test.sh", "text/plain")
+	server.On("GET", "/slow").WithDelay(50*time.Millisecond).RespondJSON(200, `{}`)
+	httpClient := server.Client()
+	defer httpClient.Close()
+
+	// the production url is sent to the stub server
+	status, resBody, err := httpClient.GetQueryRequest("https://his.example.com/patients", map[string]string{"id": "1"}, nil)
+	if err != nil || status != 200 || resBody["name"] != "Alice" {
+		t.Errorf("GetQueryRequest to stub error: %v, status: %d, body: %v", err, status, resBody)
+	}
+	var created struct{ ID int }
+	status, err = httpClient.SendJSONRequest("POST", "http://his.example.com/patients", map[string]interface{}{"age": 30, "name": "Bob"}, &created, map[string]string{"X-Api-Key": "key"})
+	if err != nil || status != 201 || created.ID != 2 {
+		t.Errorf("SendJSONRequest to stub error: %v, status: %d, id: %d", err, status, created.ID)
+	}
+	if status, _, _ := httpClient.PostBodyRequest(server.URL+"/patients", `{"name":"Carol"}`, nil); status != 404 {
+		t.Errorf("unmatched request need 404, got %d", status)
+	}
+	var out addResponse
+	if _, err := httpClient.CallSoap(server.URL+"/soap/add", &network.SoapRequest{Body: addRequest{A: 1, B: 2}}, &out, nil); err != nil || out.Result != 3 {
+		t.Errorf("CallSoap to stub error: %v, result: %d", err, out.Result)
+	}
+	var fault *network.SoapFault
+	if _, err := httpClient.CallSoap(server.URL+"/soap/fault", &network.SoapRequest{Body: addRequest{}}, nil, nil); !errors.As(err, &fault) || fault.String != "database is down" {
+		t.Errorf("CallSoap need SoapFault from stub, got %v", err)
+	}
+	script, _ := ioutil.ReadFile("run_test.sh")
+	status, file, err := httpClient.SendSoapRequest("GET", server.URL+"/files/run_test.sh", nil, nil)
+	if err != nil || status != 200 || string(file) != string(script) {
+		t.Errorf("RespondFile error: %v, status: %d", err, status)
+	}
+	start := time.Now()
+	if status, _, _ := httpClient.GetQueryRequest(server.URL+"/slow", nil, nil); status != 200 || time.Since(start) < 50*time.Millisecond {
+		t.Errorf("WithDelay need a delayed response, status: %d, elapsed: %v", status, time.Since(start))
+	}
+
+	calls := server.CallsTo("POST", "/patients")
+	if len(calls) != 2 || calls[0].Header.Get("X-Api-Key") != "key" || calls[0].Stub == nil || calls[1].Stub != nil {
+		t.Errorf("CallsTo need the matched and unmatched calls, got %+v", calls)
+	}
+	if unmatched := server.Unmatched(); len(unmatched) != 1 || string(unmatched[0].Body) != `{"name":"Carol"}` {
+		t.Errorf("Unmatched need 1 call, got %+v", unmatched)
+	}
+}
+
+func TestMockServerFaults(t *testing.T) {
+	server := mock.NewTLSServer()
+	defer server.Close()
+	server.On("GET", "/timeout").Timeout()
+	server.On("GET", "/reset").Reset()
+	server.On("GET", "/stream").SlowBody(4, 20*time.Millisecond).RespondJSON(200, `{"data":"0123456789"}`)
+	httpClient := server.Client()
+	defer httpClient.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, _, err := httpClient.SendQueryRequestWithContext(ctx, "GET", "https://his.example.com/timeout", nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Timeout need context.DeadlineExceeded, got %v", err)
+	}
+	if _, _, err := httpClient.GetQueryRequest("https://his.example.com/reset", nil, nil); err == nil {
+		t.Errorf("Reset need a connection error")
+	}
+	start := time.Now()
+	status, resBody, err := httpClient.GetQueryRequest("https://his.example.com/stream", nil, nil)
+	if err != nil || status != 200 || resBody["data"] != "0123456789" || time.Since(start) < 100*time.Millisecond {
+		t.Errorf("SlowBody error: %v, status: %d, body: %v, elapsed: %v", err, status, resBody, time.Since(start))
+	}
+	if n := len(server.Calls()); n != 3 {
+		t.Errorf("server need 3 calls, got %d", n)
+	}
+	if req := server.Calls()[0]; req.Method != http.MethodGet || req.Path != "/timeout" {
+		t.Errorf("first call need GET /timeout, got %s %s", req.Method, req.Path)
+	}
+}
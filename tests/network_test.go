@@ -0,0 +1,1404 @@
+package test_tests
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NovanHsiu/goutil/logger"
+	"github.com/NovanHsiu/goutil/network"
+)
+
+func TestSendRequestWithContextCancel(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	pt := time.Now()
+	_, _, err := httpClient.SendBodyRequestWithContext(ctx, "POST", server.URL, `{"a":1}`, nil)
+	if err == nil {
+		t.Errorf("SendBodyRequestWithContext need error after context deadline")
+	}
+	if time.Since(pt) > 2*time.Second {
+		t.Errorf("SendBodyRequestWithContext was not aborted by context, elapsed: %v", time.Since(pt))
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil || r.FormValue("name") != "goutil" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if atomic.AddInt32(&count, 1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer server.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	httpClient.RetryPolicy = network.DefaultRetryPolicy()
+	// POST is not retried unless the caller opts in
+	scode, _, _ := httpClient.PostFormDataRequest(server.URL, map[string]string{"name": "goutil"}, nil)
+	if scode != http.StatusServiceUnavailable || atomic.LoadInt32(&count) != 1 {
+		t.Errorf("PostFormDataRequest need no retry, scode: %d, count: %d", scode, count)
+	}
+	policy := network.DefaultRetryPolicy()
+	policy.RetryNonIdempotent = true
+	ctx := network.WithRetryPolicy(context.Background(), policy)
+	scode, resBody, err := httpClient.SendFormDataRequestWithContext(ctx, "POST", server.URL, map[string]string{"name": "goutil"}, nil)
+	if scode != http.StatusOK || resBody["ok"] != true || atomic.LoadInt32(&count) != 3 {
+		t.Errorf("SendFormDataRequestWithContext need retry, scode: %d, count: %d, error: %v", scode, count, err)
+	}
+}
+
+func TestRetryDeterministicErrors(t *testing.T) {
+	var conns int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	httpClient.RetryPolicy = &network.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	// the certificate of the server is not trusted
+	if _, _, err := httpClient.GetQueryRequest(server.URL, nil, nil); !errors.Is(err, network.ErrTLS) || atomic.LoadInt32(&conns) != 1 {
+		t.Errorf("tls error need exactly one attempt, error: %v, attempts: %d", err, conns)
+	}
+	var calls int32
+	httpClient.Use(network.RequestInterceptor(func(req *http.Request) error {
+		atomic.AddInt32(&calls, 1)
+		return errors.New("rejected")
+	}))
+	if _, _, err := httpClient.GetQueryRequest(server.URL, nil, nil); !errors.Is(err, network.ErrMiddleware) || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("middleware error need exactly one attempt, error: %v, attempts: %d", err, calls)
+	}
+	// a refused connection is retried
+	server.Close()
+	retryClient := network.NewHttpClient(10, false, true)
+	defer retryClient.Close()
+	retryClient.RetryPolicy = httpClient.RetryPolicy
+	var attempts int32
+	retryClient.Use(network.RequestInterceptor(func(req *http.Request) error {
+		atomic.AddInt32(&attempts, 1)
+		return nil
+	}))
+	if _, _, err := retryClient.GetQueryRequest(server.URL, nil, nil); !errors.Is(err, network.ErrTransport) || atomic.LoadInt32(&attempts) != 3 {
+		t.Errorf("refused connection need 3 attempts, error: %v, attempts: %d", err, attempts)
+	}
+}
+
+func TestDoJSON(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.Write([]byte("\xef\xbb\xbfnot json"))
+			return
+		}
+		w.Write([]byte("\xef\xbb\xbf" + `[{"id":1,"name":"a"},{"id":2,"name":"b"}]`))
+	}))
+	defer server.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	type item struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	var items []item
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	scode, err := httpClient.DoJSON(req, &items)
+	if scode != http.StatusOK || err != nil || len(items) != 2 || items[1].Name != "b" {
+		t.Errorf("DoJSON decode array failed, scode: %d, error: %v, items: %v", scode, err, items)
+	}
+	_, err = httpClient.SendJSONRequest("POST", server.URL+"/broken", map[string]int{"id": 1}, &items, nil)
+	var decodeErr *network.DecodeError
+	if !errors.As(err, &decodeErr) || string(decodeErr.Body) != "not json" {
+		t.Errorf("SendJSONRequest need DecodeError with raw body, error: %v", err)
+	}
+}
+
+func TestPostFormDataWithFilePartsRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		files := r.MultipartForm.File["upload_files"]
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"content_length": r.ContentLength,
+			"dir":            r.FormValue("dir"),
+			"files":          len(files),
+			"name":           files[1].Filename,
+			"content_type":   files[1].Header.Get("Content-Type"),
+		})
+	}))
+	defer server.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	filePart, err := network.NewFilePart("upload_files", "run_test.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	readerPart := network.NewReaderFilePart("upload_files", "report.csv", "text/csv", strings.NewReader("id,name\n1,a\n"))
+	scode, resBody, err := httpClient.PostFormDataWithFilePartsRequest(server.URL, map[string]string{"dir": "test"}, []network.FilePart{filePart, readerPart}, nil)
+	if scode != http.StatusOK || err != nil {
+		t.Fatalf("PostFormDataWithFilePartsRequest failed, scode: %d, error: %v", scode, err)
+	}
+	if resBody["content_length"].(float64) <= 0 || resBody["dir"] != "test" || resBody["files"].(float64) != 2 ||
+		resBody["name"] != "report.csv" || resBody["content_type"] != "text/csv" {
+		t.Errorf("PostFormDataWithFilePartsRequest unexpected form: %v", resBody)
+	}
+	// a reader which can not be replayed is buffered by the signer instead of being opened again
+	httpClient.Signer = network.NewHMACSigner("partner", []byte("secret"))
+	streamPart := network.NewReaderFilePart("upload_files", "stream.csv", "text/csv", io.MultiReader(strings.NewReader("id,name\n2,b\n")))
+	scode, resBody, err = httpClient.PostFormDataWithFilePartsRequest(server.URL, nil, []network.FilePart{filePart, streamPart}, nil)
+	if scode != http.StatusOK || err != nil || resBody["name"] != "stream.csv" {
+		t.Errorf("PostFormDataWithFilePartsRequest with a non-seekable part and Signer failed, scode: %d, error: %v", scode, err)
+	}
+}
+
+func TestDownloadFileResume(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 10000))
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1) == 1 {
+			// send half of the file then drop the connection
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Header().Set("ETag", `"v1"`)
+			w.Write(content[:len(content)/2])
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	dir, _ := ioutil.TempDir("", "goutil")
+	defer os.RemoveAll(dir)
+	sum := sha256.Sum256(content)
+	var done, total int64
+	opts := network.DefaultDownloadOptions()
+	opts.ExpectedSHA256 = hex.EncodeToString(sum[:])
+	opts.Progress = func(d, t int64) { done, total = d, t }
+	err := httpClient.DownloadFileWithOptions(context.Background(), server.URL, dir+"/data.bin", nil, opts)
+	if err != nil || done != int64(len(content)) || total != int64(len(content)) || atomic.LoadInt32(&count) != 2 {
+		t.Fatalf("DownloadFileWithOptions failed, error: %v, progress: %d/%d, requests: %d", err, done, total, count)
+	}
+	data, _ := ioutil.ReadFile(dir + "/data.bin")
+	if !bytes.Equal(data, content) {
+		t.Errorf("DownloadFileWithOptions downloaded content mismatch, size: %d", len(data))
+	}
+	// the downloaded file has the mode of a file created by os.Create
+	created, _ := os.Create(dir + "/created.bin")
+	created.Close()
+	createdInfo, _ := os.Stat(dir + "/created.bin")
+	os.Remove(dir + "/created.bin")
+	if info, err := os.Stat(dir + "/data.bin"); err != nil {
+		t.Errorf("stat downloaded file error: %v", err)
+	} else if info.Mode() != createdInfo.Mode() {
+		t.Errorf("DownloadFileWithOptions file mode need %v, got %v", createdInfo.Mode(), info.Mode())
+	}
+	opts.ExpectedSHA256 = strings.Repeat("0", 64)
+	err = httpClient.DownloadFileWithOptions(context.Background(), server.URL, dir+"/bad.bin", nil, opts)
+	files, _ := ioutil.ReadDir(dir)
+	if err == nil || len(files) != 1 {
+		t.Errorf("DownloadFileWithOptions need checksum error and no file left, error: %v, files: %d", err, len(files))
+	}
+}
+
+func TestDownloadFileSegmented(t *testing.T) {
+	content := []byte(strings.Repeat("abcdefghij", 10000))
+	var ranges int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/norange" {
+			w.Write(content)
+			return
+		}
+		if r.URL.Path == "/probeonly" {
+			// only the probe is answered with partial content, segments get the whole file
+			if r.Header.Get("Range") != "bytes=0-0" {
+				r.Header.Del("Range")
+			}
+			http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(content))
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(&ranges, 1)
+		}
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	dir, _ := ioutil.TempDir("", "goutil")
+	defer os.RemoveAll(dir)
+	opts := network.DefaultDownloadOptions()
+	opts.Segments = 4
+	opts.MinSegmentSize = 1000
+	for _, path := range []string{"/", "/norange", "/probeonly"} {
+		err := httpClient.DownloadFileWithOptions(context.Background(), server.URL+path, dir+"/data.bin", nil, opts)
+		data, _ := ioutil.ReadFile(dir + "/data.bin")
+		if err != nil || !bytes.Equal(data, content) {
+			t.Errorf("DownloadFileWithOptions %s failed, error: %v, size: %d", path, err, len(data))
+		}
+	}
+	// 1 probe and 4 segments
+	if atomic.LoadInt32(&ranges) != 5 {
+		t.Errorf("DownloadFileWithOptions need 5 range requests, got %d", ranges)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-Id", r.Header.Get("X-Request-Id"))
+		w.Write([]byte(`{"auth":"` + r.Header.Get("Authorization") + `"}`))
+	}))
+	defer server.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	var order []string
+	httpClient.Use(
+		network.RequestInterceptor(func(req *http.Request) error {
+			order = append(order, "auth")
+			req.Header.Set("Authorization", "Bearer token")
+			return nil
+		}),
+		network.RequestInterceptor(func(req *http.Request) error {
+			order = append(order, "request-id")
+			req.Header.Set("X-Request-Id", "abc")
+			return nil
+		}),
+		network.ResponseInterceptor(func(req *http.Request, res *http.Response) error {
+			if res.Header.Get("X-Request-Id") != "abc" {
+				return errors.New("request id not echoed")
+			}
+			return nil
+		}),
+	)
+	scode, resBody, err := httpClient.GetQueryRequest(server.URL, nil, nil)
+	if scode != http.StatusOK || err != nil || resBody["auth"] != "Bearer token" || strings.Join(order, ",") != "auth,request-id" {
+		t.Errorf("middleware failed, scode: %d, error: %v, body: %v, order: %v", scode, err, resBody, order)
+	}
+}
+
+func TestHttpClientLogger(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	buf := &bytes.Buffer{}
+	httpClient.Logger = logger.NewJSONLogger(buf, logger.LevelWarn)
+	httpClient.SlowRequestThreshold = 10 * time.Millisecond
+	httpClient.GetQueryRequest(server.URL, nil, nil)
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil || entry["level"] != "warn" || entry["url"] != server.URL {
+		t.Errorf("HttpClient need slow response log, error: %v, log: %s", err, buf.String())
+	}
+}
+
+func TestSendQueryValuesRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"query":"` + r.URL.RawQuery + `"}`))
+	}))
+	defer server.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	_, resBody, err := httpClient.GetQueryRequest(server.URL+"?page=1", map[string]string{"name": "a&b c"}, nil)
+	if err != nil || resBody["query"] != "name=a%26b+c&page=1" {
+		t.Errorf("GetQueryRequest query need escaped and merged, error: %v, body: %v", err, resBody)
+	}
+	type query struct {
+		IDs    []int  `url:"id"`
+		Name   string `url:"name,omitempty"`
+		Active bool   `url:"active"`
+		Secret string `url:"-"`
+	}
+	_, resBody, err = httpClient.GetQueryValuesRequest(server.URL, query{IDs: []int{3, 1}, Active: true, Secret: "x"}, nil)
+	if err != nil || resBody["query"] != "active=true&id=3&id=1" {
+		t.Errorf("GetQueryValuesRequest struct query failed, error: %v, body: %v", err, resBody)
+	}
+}
+
+func TestPostURLEncodedFormRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"content_type": r.Header.Get("Content-Type"),
+			"scope":        r.PostForm["scope"],
+			"grant_type":   r.PostForm.Get("grant_type"),
+		})
+	}))
+	defer server.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	params := url.Values{"grant_type": {"client_credentials"}, "scope": {"read", "write&admin"}}
+	_, resBody, err := httpClient.PostURLEncodedFormRequest(server.URL, params, nil)
+	scope, _ := resBody["scope"].([]interface{})
+	if err != nil || resBody["content_type"] != "application/x-www-form-urlencoded" || resBody["grant_type"] != "client_credentials" ||
+		len(scope) != 2 || scope[1] != "write&admin" {
+		t.Errorf("PostURLEncodedFormRequest failed, error: %v, body: %v", err, resBody)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	var changes []string
+	breaker := network.NewCircuitBreaker()
+	breaker.MinRequests = 2
+	breaker.CoolDown = 50 * time.Millisecond
+	breaker.OnStateChange = func(host string, from, to network.CircuitState) {
+		changes = append(changes, to.String())
+	}
+	httpClient.CircuitBreaker = breaker
+	httpClient.GetQueryRequest(server.URL, nil, nil)
+	httpClient.GetQueryRequest(server.URL, nil, nil)
+	_, _, err := httpClient.GetQueryRequest(server.URL, nil, nil)
+	if !errors.Is(err, network.ErrCircuitOpen) {
+		t.Errorf("GetQueryRequest need ErrCircuitOpen, error: %v", err)
+	}
+	atomic.StoreInt32(&healthy, 1)
+	time.Sleep(60 * time.Millisecond)
+	scode, _, err := httpClient.GetQueryRequest(server.URL, nil, nil)
+	if scode != http.StatusOK || err != nil || strings.Join(changes, ",") != "open,half-open,closed" {
+		t.Errorf("circuit need closed after cool-down, scode: %d, error: %v, changes: %v", scode, err, changes)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	httpClient.RateLimiter = network.NewRateLimiter(network.RateLimit{RequestsPerSecond: 20, Burst: 1, MaxConcurrent: 1})
+	pt := time.Now()
+	scode, _, _ := httpClient.GetQueryRequest(server.URL, nil, nil)
+	if scode != http.StatusTooManyRequests {
+		t.Fatalf("GetQueryRequest need 429, scode: %d", scode)
+	}
+	// the bucket is paused by Retry-After
+	httpClient.GetQueryRequest(server.URL, nil, nil)
+	if time.Since(pt) < time.Second {
+		t.Errorf("RateLimiter need to pause 1 second after 429, elapsed: %v", time.Since(pt))
+	}
+	// 5 requests with 20 rps and burst 1 need at least 200ms
+	pt = time.Now()
+	for i := 0; i < 5; i++ {
+		httpClient.GetQueryRequest(server.URL, nil, nil)
+	}
+	if time.Since(pt) < 190*time.Millisecond {
+		t.Errorf("RateLimiter need to limit the rate, elapsed: %v", time.Since(pt))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := httpClient.SendQueryRequestWithContext(ctx, "GET", server.URL, nil, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("RateLimiter need to respect context, error: %v", err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		w.Header().Set("ETag", `"v1"`)
+		if r.URL.Path == "/fresh" {
+			w.Header().Set("Cache-Control", "max-age=60")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Write([]byte(`{"path":"` + r.URL.Path + `"}`))
+	}))
+	defer server.Close()
+	dir, _ := ioutil.TempDir("", "goutil")
+	defer os.RemoveAll(dir)
+	diskStorage, err := network.NewDiskCacheStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, storage := range []network.CacheStorage{network.NewMemoryCacheStorage(10), diskStorage} {
+		atomic.StoreInt32(&count, 0)
+		httpClient := network.NewHttpClient(10, false, true)
+		httpClient.Cache = network.NewCache(storage)
+		for i := 0; i < 3; i++ {
+			_, resBody, err := httpClient.GetQueryRequest(server.URL+"/fresh", nil, nil)
+			if err != nil || resBody["path"] != "/fresh" {
+				t.Errorf("GetQueryRequest from cache failed, error: %v, body: %v", err, resBody)
+			}
+		}
+		if atomic.LoadInt32(&count) != 1 {
+			t.Errorf("fresh response need to be served from cache, requests: %d", count)
+		}
+		for i := 0; i < 2; i++ {
+			scode, resBody, err := httpClient.GetQueryRequest(server.URL+"/revalidate", nil, nil)
+			if scode != http.StatusOK || err != nil || resBody["path"] != "/revalidate" {
+				t.Errorf("GetQueryRequest revalidate failed, scode: %d, error: %v, body: %v", scode, err, resBody)
+			}
+		}
+		httpClient.Close()
+	}
+}
+
+func TestCacheCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(`{"user":"` + r.Header.Get("Authorization") + r.Header.Get("Cookie") + `"}`))
+	}))
+	defer server.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	httpClient.Cache = network.NewCache(network.NewMemoryCacheStorage(10))
+	for i := 0; i < 2; i++ {
+		for _, user := range []string{"alice", "bob"} {
+			_, resBody, err := httpClient.GetQueryRequest(server.URL, nil, map[string]string{"Authorization": user})
+			if err != nil || resBody["user"] != user {
+				t.Errorf("caller %s need its own response, error: %v, body: %v", user, err, resBody)
+			}
+			_, resBody, err = httpClient.GetQueryRequest(server.URL, nil, map[string]string{"Cookie": "session=" + user})
+			if err != nil || resBody["user"] != "session="+user {
+				t.Errorf("caller with cookie of %s need its own response, error: %v, body: %v", user, err, resBody)
+			}
+		}
+	}
+}
+
+func TestCacheCredentialsOfMiddleware(t *testing.T) {
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		if r.URL.Path == "/public" {
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Write([]byte(`{"user":"` + r.Header.Get("Authorization") + `"}`))
+	}))
+	defer server.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	httpClient.Cache = network.NewCache(network.NewMemoryCacheStorage(10))
+	// the credentials are set by a middleware from the header of the caller, after the cache
+	httpClient.Use(network.RequestInterceptor(func(req *http.Request) error {
+		req.Header.Set("Authorization", req.Header.Get("X-User"))
+		req.Header.Del("X-User")
+		return nil
+	}))
+	for i := 0; i < 2; i++ {
+		for _, user := range []string{"alice", "bob"} {
+			_, resBody, err := httpClient.GetQueryRequest(server.URL+"/private", nil, map[string]string{"X-User": user})
+			if err != nil || resBody["user"] != user {
+				t.Errorf("caller %s need its own response, error: %v, body: %v", user, err, resBody)
+			}
+		}
+	}
+	if n := atomic.LoadInt32(&count); n != 4 {
+		t.Errorf("responses to credentials of middleware need not to be stored, requests: %d", n)
+	}
+	for i := 0; i < 2; i++ {
+		httpClient.GetQueryRequest(server.URL+"/public", nil, map[string]string{"X-User": "alice"})
+	}
+	if n := atomic.LoadInt32(&count); n != 5 {
+		t.Errorf("public response need to be stored, requests: %d", n)
+	}
+}
+
+func TestCookieJar(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+		}
+		session := ""
+		if cookie, err := r.Cookie("session"); err == nil {
+			session = cookie.Value
+		}
+		w.Write([]byte(`{"session":"` + session + `"}`))
+	}))
+	defer server.Close()
+	dir, _ := ioutil.TempDir("", "goutil")
+	defer os.RemoveAll(dir)
+	for _, reused := range []bool{true, false} {
+		jar, err := network.NewCookieJar(dir + "/cookies.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpClient := network.NewHttpClient(10, false, reused)
+		httpClient.SetCookieJar(jar)
+		httpClient.GetQueryRequest(server.URL+"/login", nil, nil)
+		if err := jar.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// a new jar loads the session saved by the previous one
+		jar, err = network.NewCookieJar(dir + "/cookies.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		httpClient = network.NewHttpClient(10, false, reused)
+		httpClient.SetCookieJar(jar)
+		_, resBody, _ := httpClient.GetQueryRequest(server.URL+"/profile", nil, nil)
+		cookies, _ := httpClient.Cookies(server.URL)
+		if resBody["session"] != "abc" || len(cookies) != 1 || len(jar.All()) != 1 {
+			t.Errorf("cookie jar need to keep session, reused client: %v, body: %v, cookies: %v", reused, resBody, cookies)
+		}
+		httpClient.ClearCookies()
+		_, resBody, _ = httpClient.GetQueryRequest(server.URL+"/profile", nil, nil)
+		if resBody["session"] != "" {
+			t.Errorf("ClearCookies need to remove session, body: %v", resBody)
+		}
+	}
+}
+
+func TestCookieJarSave(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: r.URL.Path, Path: "/"})
+	}))
+	defer server.Close()
+	dir, _ := ioutil.TempDir("", "goutil")
+	defer os.RemoveAll(dir)
+	path := dir + "/cookies.json"
+	jar, _ := network.NewCookieJar(path)
+	httpClient := network.NewHttpClient(10, false, true)
+	httpClient.SetCookieJar(jar)
+	for i := 0; i < 3; i++ {
+		httpClient.GetQueryRequest(server.URL+"/"+strconv.Itoa(i), nil, nil)
+	}
+	// the changes are saved together instead of on every response
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("cookies need to be saved in batches, stat error: %v", err)
+	}
+	if err := jar.Close(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := network.NewCookieJar(path)
+	if err != nil || len(saved.All()) != 1 || saved.All()[0].Value != "/2" {
+		t.Errorf("Close need to save the last cookies, error: %v", err)
+	}
+	// a failed save is returned by Close
+	jar, _ = network.NewCookieJar(dir + "/missing/cookies.json")
+	httpClient.SetCookieJar(jar)
+	httpClient.GetQueryRequest(server.URL+"/login", nil, nil)
+	if err := jar.Close(); err == nil {
+		t.Error("Close need to return the error of saving the cookies")
+	}
+	if err := jar.Save(); err == nil {
+		t.Error("Save need to return the error of saving the cookies")
+	}
+}
+
+func TestProxy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"via":"direct"}`))
+	}))
+	defer server.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a http proxy receives the absolute url of the target
+		w.Write([]byte(`{"via":"proxy","target":"` + r.URL.String() + `","auth":"` + r.Header.Get("Proxy-Authorization") + `"}`))
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("user", "pass")
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	if err := httpClient.SetProxy(&network.ProxyConfig{URL: "ftp://proxy"}); err == nil {
+		t.Errorf("SetProxy need error of unsupported scheme")
+	}
+	httpClient.SetProxy(&network.ProxyConfig{URL: proxyURL.String(), NoProxy: []string{"10.0.0.0/8", "internal.example.com"}})
+	target := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	_, resBody, err := httpClient.GetQueryRequest(target, nil, nil)
+	if err != nil || resBody["via"] != "proxy" || !strings.HasPrefix(resBody["auth"].(string), "Basic ") {
+		t.Errorf("GetQueryRequest need to go through proxy, error: %v, body: %v", err, resBody)
+	}
+	httpClient.SetProxy(&network.ProxyConfig{URL: proxyURL.String(), NoProxy: []string{"127.0.0.0/8"}})
+	_, resBody, err = httpClient.GetQueryRequest(server.URL, nil, nil)
+	if err != nil || resBody["via"] != "direct" {
+		t.Errorf("GetQueryRequest need to bypass proxy by NoProxy, error: %v, body: %v", err, resBody)
+	}
+	ctx := network.WithProxy(context.Background(), proxy.URL)
+	_, resBody, err = httpClient.SendQueryRequestWithContext(ctx, "GET", server.URL, nil, nil)
+	if err != nil || resBody["via"] != "proxy" {
+		t.Errorf("WithProxy need to override proxy per request, error: %v, body: %v", err, resBody)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"clients":` + strconv.Itoa(len(r.TLS.PeerCertificates)) + `}`))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+
+	httpClient := network.NewDefaultHttpClient()
+	defer httpClient.Close()
+	if _, _, err := httpClient.GetQueryRequest(server.URL, nil, nil); err == nil {
+		t.Errorf("NewDefaultHttpClient need to verify the certificate of the server")
+	}
+	// the server requires a client certificate, reuse its own certificate for mutual TLS
+	err := httpClient.SetTLSConfig(&network.TLSConfig{CAPEM: caPEM, Certificates: server.TLS.Certificates})
+	if err != nil {
+		t.Fatalf("SetTLSConfig error: %v", err)
+	}
+	status, resBody, err := httpClient.GetQueryRequest(server.URL, nil, nil)
+	if err != nil || status != 200 || resBody["clients"] != float64(1) {
+		t.Errorf("GetQueryRequest with CA and client certificate failed, status: %d, error: %v, body: %v", status, err, resBody)
+	}
+	httpClient.SetTLSConfig(&network.TLSConfig{
+		CAPEM:            caPEM,
+		Certificates:     server.TLS.Certificates,
+		PinnedSPKISHA256: []string{network.SPKIHash(server.Certificate())},
+	})
+	if _, _, err := httpClient.GetQueryRequest(server.URL, nil, nil); err != nil {
+		t.Errorf("GetQueryRequest with matched pin error: %v", err)
+	}
+	httpClient.SetTLSConfig(&network.TLSConfig{
+		CAPEM:            caPEM,
+		Certificates:     server.TLS.Certificates,
+		PinnedSPKISHA256: []string{"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+	})
+	if _, _, err := httpClient.GetQueryRequest(server.URL, nil, nil); !errors.Is(err, network.ErrCertificatePinMismatch) {
+		t.Errorf("GetQueryRequest need ErrCertificatePinMismatch, got %v", err)
+	}
+	if err := httpClient.SetTLSConfig(&network.TLSConfig{PinnedSPKISHA256: []string{"not a pin"}}); err == nil {
+		t.Errorf("SetTLSConfig need error of invalid pin")
+	}
+}
+
+func TestOAuth2TokenSource(t *testing.T) {
+	var tokenRequests, issued int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&tokenRequests, 1)
+		user, pass, _ := r.BasicAuth()
+		r.ParseForm()
+		switch {
+		case user != "id" || pass != "secret":
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		case r.Form.Get("grant_type") == "refresh_token" && r.Form.Get("refresh_token") != "refresh-"+strconv.Itoa(int(atomic.LoadInt32(&issued))):
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		n := strconv.Itoa(int(atomic.AddInt32(&issued, 1)))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token-` + n + `","token_type":"bearer","expires_in":3600,"refresh_token":"refresh-` + n + `"}`))
+	}))
+	defer tokenServer.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// only the latest token is accepted
+		if r.Header.Get("Authorization") != "Bearer token-"+strconv.Itoa(int(atomic.LoadInt32(&issued))) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer server.Close()
+
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	config := network.OAuth2Config{TokenURL: tokenServer.URL, ClientID: "id", ClientSecret: "secret", Scopes: []string{"read"}}
+	httpClient.TokenSource = network.NewClientCredentialsTokenSource(httpClient, config)
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			status, _, err := httpClient.GetQueryRequest(server.URL, nil, nil)
+			if err == nil && status != 200 {
+				err = errors.New("status code is " + strconv.Itoa(status))
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("GetQueryRequest with token error: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&tokenRequests); n != 1 {
+		t.Errorf("concurrent requests need to share 1 token request, got %d", n)
+	}
+	// the server revokes the cached token, the client refreshes it once and sends the request again
+	atomic.AddInt32(&issued, 1)
+	if status, _, err := httpClient.GetQueryRequest(server.URL, nil, nil); err != nil || status != 200 {
+		t.Errorf("GetQueryRequest need to retry with refreshed token, status: %d, error: %v", status, err)
+	}
+	if n := atomic.LoadInt32(&tokenRequests); n != 2 {
+		t.Errorf("token requests need to be 2, got %d", n)
+	}
+
+	var saved string
+	config.OnToken = func(token *network.Token) { saved = token.RefreshToken }
+	httpClient.TokenSource = network.NewRefreshTokenSource(httpClient, config, "refresh-"+strconv.Itoa(int(atomic.LoadInt32(&issued))))
+	if status, _, err := httpClient.GetQueryRequest(server.URL, nil, nil); err != nil || status != 200 {
+		t.Errorf("GetQueryRequest with refresh token source failed, status: %d, error: %v", status, err)
+	}
+	if saved != "refresh-"+strconv.Itoa(int(atomic.LoadInt32(&issued))) {
+		t.Errorf("OnToken need the rotated refresh token, got %s", saved)
+	}
+
+	config.ClientSecret = "wrong"
+	httpClient.TokenSource = network.NewClientCredentialsTokenSource(httpClient, config)
+	var oauthErr *network.OAuth2Error
+	if _, _, err := httpClient.GetQueryRequest(server.URL, nil, nil); !errors.As(err, &oauthErr) || oauthErr.Code != "invalid_client" {
+		t.Errorf("GetQueryRequest need OAuth2Error invalid_client, got %v", err)
+	}
+}
+
+func TestHMACSigner(t *testing.T) {
+	signer := network.NewHMACSigner("partner", []byte("secret"))
+	signer.SignedHeaders = []string{"host", "Content-Type"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := network.VerifyHMACRequest(r, signer, time.Minute); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"` + err.Error() + `"}`))
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(`{"key":"` + r.Header.Get("X-Key-Id") + `","body":` + strconv.Quote(string(body)) + `}`))
+	}))
+	defer server.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	httpClient.Signer = signer
+	// a middleware changing the request before it is signed
+	httpClient.Use(network.RequestInterceptor(func(req *http.Request) error {
+		req.Header.Set("Content-Type", "application/json")
+		return nil
+	}))
+	status, resBody, err := httpClient.PostBodyRequest(server.URL+"/orders?b=2&a=1&a=0", `{"id":1}`, nil)
+	if err != nil || status != 200 || resBody["key"] != "partner" || resBody["body"] != `{"id":1}` {
+		t.Errorf("PostBodyRequest need to be signed, status: %d, error: %v, body: %v", status, err, resBody)
+	}
+	status, _, _ = httpClient.GetQueryRequest(server.URL+"/orders", map[string]string{"q": "x y"}, nil)
+	if status != 200 {
+		t.Errorf("GetQueryRequest need to be signed, status: %d", status)
+	}
+
+	req := httptest.NewRequest("POST", "http://example.com/orders", strings.NewReader(`{"id":1}`))
+	req.Header.Set("Content-Type", "application/json")
+	if err := network.VerifyHMACRequest(req, signer, 0); !errors.Is(err, network.ErrInvalidSignature) {
+		t.Errorf("VerifyHMACRequest need ErrInvalidSignature without signature, got %v", err)
+	}
+	req.GetBody = func() (io.ReadCloser, error) { return ioutil.NopCloser(strings.NewReader(`{"id":1}`)), nil }
+	if err := signer.Sign(req); err != nil {
+		t.Fatalf("Sign error: %v", err)
+	}
+	if err := network.VerifyHMACRequest(req, signer, 0); err != nil {
+		t.Errorf("VerifyHMACRequest error: %v", err)
+	}
+	req.Body = ioutil.NopCloser(strings.NewReader(`{"id":2}`))
+	if err := network.VerifyHMACRequest(req, signer, 0); !errors.Is(err, network.ErrInvalidSignature) {
+		t.Errorf("VerifyHMACRequest need ErrInvalidSignature for a changed body, got %v", err)
+	}
+	req.Header.Set("X-Timestamp", strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+	if err := network.VerifyHMACRequest(req, signer, 0); !errors.Is(err, network.ErrSignatureExpired) {
+		t.Errorf("VerifyHMACRequest need ErrSignatureExpired, got %v", err)
+	}
+}
+
+type addRequest struct {
+	XMLName xml.Name `xml:"http://example.com/calc Add"`
+	A       int      `xml:"a"`
+	B       int      `xml:"b"`
+}
+
+type addResponse struct {
+	Result int `xml:"result"`
+}
+
+func TestCallSoap(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		switch {
+		case r.Header.Get("SOAPAction") == `"http://example.com/calc/Add"` && bytes.Contains(body, []byte("<Session>1</Session>")):
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>` +
+				`<AddResponse xmlns="http://example.com/calc"><result>3</result></AddResponse></s:Body></s:Envelope>`))
+		case strings.Contains(r.Header.Get("Content-Type"), `action="http://example.com/calc/Add"`):
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`<env:Envelope xmlns:env="http://www.w3.org/2003/05/soap-envelope"><env:Body><env:Fault>` +
+				`<env:Code><env:Value>env:Sender</env:Value><env:Subcode><env:Value>InvalidNumber</env:Value></env:Subcode></env:Code>` +
+				`<env:Reason><env:Text xml:lang="en">b is too large</env:Text></env:Reason>` +
+				`<env:Detail><limit>100</limit></env:Detail></env:Fault></env:Body></env:Envelope>`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>` +
+				`<faultcode>s:Client</faultcode><faultstring>unknown action</faultstring></s:Fault></s:Body></s:Envelope>`))
+		}
+	}))
+	defer server.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	soapReq := &network.SoapRequest{
+		Action:  "http://example.com/calc/Add",
+		Headers: []interface{}{"<Session>1</Session>"},
+		Body:    addRequest{A: 1, B: 2},
+	}
+	var out addResponse
+	status, err := httpClient.CallSoap(server.URL, soapReq, &out, nil)
+	if err != nil || status != 200 || out.Result != 3 {
+		t.Errorf("CallSoap error: %v, status: %d, result: %d", err, status, out.Result)
+	}
+	soapReq.Version = network.Soap12
+	_, err = httpClient.CallSoap(server.URL, soapReq, &out, nil)
+	var fault *network.SoapFault
+	if !errors.As(err, &fault) || fault.Code != "env:Sender" || fault.Subcode != "InvalidNumber" ||
+		fault.String != "b is too large" || string(fault.Detail) != "<limit>100</limit>" || fault.StatusCode != 500 {
+		t.Errorf("CallSoap need SOAP 1.2 fault, got %#v", err)
+	}
+	soapReq.Version = network.Soap11
+	soapReq.Action = "unknown"
+	_, err = httpClient.CallSoap(server.URL, soapReq, &out, nil)
+	if !errors.As(err, &fault) || fault.Code != "s:Client" || fault.String != "unknown action" {
+		t.Errorf("CallSoap need SOAP 1.1 fault, got %#v", err)
+	}
+}
+
+func TestWSSecurity(t *testing.T) {
+	type usernameToken struct {
+		Username string `xml:"Username"`
+		Password string `xml:"Password"`
+		Nonce    string `xml:"Nonce"`
+		Created  string `xml:"Created"`
+	}
+	type envelope struct {
+		Header struct {
+			Security struct {
+				Timestamp struct {
+					Created string `xml:"Created"`
+					Expires string `xml:"Expires"`
+				} `xml:"Timestamp"`
+				UsernameToken usernameToken `xml:"UsernameToken"`
+			} `xml:"Security"`
+			Session string `xml:"Session"`
+		} `xml:"Header"`
+	}
+	var nonces []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var env envelope
+		xml.Unmarshal(body, &env)
+		token := env.Header.Security.UsernameToken
+		nonces = append(nonces, token.Nonce)
+		if r.URL.Path == "/flaky" && len(nonces) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		nonce, _ := base64.StdEncoding.DecodeString(token.Nonce)
+		if token.Username != "his" || token.Password != network.WSSecurityPasswordDigest(nonce, token.Created, "p@ss") ||
+			env.Header.Security.Timestamp.Expires == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>` +
+				`<faultcode>wsse:FailedAuthentication</faultcode><faultstring>` + string(body) + `</faultstring></s:Fault></s:Body></s:Envelope>`))
+			return
+		}
+		w.Write([]byte(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>` +
+			`<AddResponse><result>` + env.Header.Session + `</result></AddResponse></s:Body></s:Envelope>`))
+	}))
+	defer server.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	httpClient.WSSecurity = &network.WSSecurity{Username: "his", Password: "p@ss"}
+	var out addResponse
+	soapReq := &network.SoapRequest{Action: "Add", Headers: []interface{}{"<Session>7</Session>"}, Body: addRequest{A: 1, B: 2}}
+	if _, err := httpClient.CallSoap(server.URL, soapReq, &out, nil); err != nil || out.Result != 7 {
+		t.Errorf("CallSoap with WSSecurity error: %v, result: %d", err, out.Result)
+	}
+	for _, payload := range []string{
+		`<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/"><soapenv:Body><Add/></soapenv:Body></soapenv:Envelope>`,
+		`<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/"><soapenv:Header/><soapenv:Body><Add/></soapenv:Body></soapenv:Envelope>`,
+	} {
+		status, body, err := httpClient.PostSoapRequest(server.URL, []byte(payload), nil)
+		if err != nil || status != 200 {
+			t.Errorf("PostSoapRequest with WSSecurity error: %v, status: %d, body: %s", err, status, body)
+		}
+	}
+	if _, _, err := httpClient.PostSoapRequest(server.URL, []byte(`<Add/>`), nil); err == nil {
+		t.Errorf("PostSoapRequest need error when payload is not an envelope")
+	}
+	// a retry is sent with a new nonce
+	nonces = nil
+	policy := &network.RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, RetryNonIdempotent: true, RetryStatusCodes: []int{503}}
+	ctx := network.WithRetryPolicy(context.Background(), policy)
+	if _, err := httpClient.CallSoapWithContext(ctx, server.URL+"/flaky", soapReq, &out, nil); err != nil || len(nonces) != 2 || nonces[0] == nonces[1] {
+		t.Errorf("CallSoap retry need a new nonce, error: %v, nonces: %v", err, nonces)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Write([]byte(`{"path":"` + r.URL.Path + `","size":` + strconv.Itoa(len(body)) + `}`))
+	}))
+	fixture := t.TempDir() + "/fixtures/recorder.json"
+	recorder, err := network.NewRecorder(fixture, network.RecordModeRecord)
+	if err != nil {
+		t.Fatalf("NewRecorder error: %v", err)
+	}
+	recorder.RedactQuery = []string{"api_key"}
+	recorder.Matchers = []network.Matcher{network.MatchMethod, network.MatchURL, network.MatchBody}
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	httpClient.Recorder = recorder
+	header := map[string]string{"Authorization": "Bearer secret"}
+	files := []network.FilePart{network.NewReaderFilePart("file", "a.txt", "text/plain", strings.NewReader("hello"))}
+	_, resBody, err := httpClient.PostFormDataWithFilePartsRequest(server.URL+"/upload", map[string]string{"dir": "test"}, files, header)
+	if err != nil || resBody["path"] != "/upload" {
+		t.Errorf("PostFormDataWithFilePartsRequest in record mode error: %v, body: %v", err, resBody)
+	}
+	status, soapBody, err := httpClient.PostSoapRequest(server.URL+"/soap?api_key=secret", []byte("<Envelope/>"), header)
+	if err != nil || status != 200 {
+		t.Errorf("PostSoapRequest in record mode error: %v, status: %d", err, status)
+	}
+	server.Close()
+	data, _ := ioutil.ReadFile(fixture)
+	if len(data) == 0 || bytes.Contains(data, []byte("secret")) {
+		t.Errorf("fixture need to be saved without secrets: %s", data)
+	}
+
+	recorder, err = network.NewRecorder(fixture, network.RecordModeReplay)
+	if err != nil {
+		t.Fatalf("NewRecorder error: %v", err)
+	}
+	recorder.RedactQuery = []string{"api_key"}
+	recorder.Matchers = []network.Matcher{network.MatchMethod, network.MatchURL, network.MatchBody}
+	httpClient.Recorder = recorder
+	files = []network.FilePart{network.NewReaderFilePart("file", "a.txt", "text/plain", strings.NewReader("hello"))}
+	_, resBody, err = httpClient.PostFormDataWithFilePartsRequest(server.URL+"/upload", map[string]string{"dir": "test"}, files, header)
+	if err != nil || resBody["path"] != "/upload" {
+		t.Errorf("PostFormDataWithFilePartsRequest in replay mode error: %v, body: %v", err, resBody)
+	}
+	status, replayed, err := httpClient.PostSoapRequest(server.URL+"/soap?api_key=other", []byte("<Envelope/>"), nil)
+	if err != nil || status != 200 || !bytes.Equal(replayed, soapBody) {
+		t.Errorf("PostSoapRequest in replay mode error: %v, status: %d, body: %s", err, status, replayed)
+	}
+	_, _, err = httpClient.PostSoapRequest(server.URL+"/soap", []byte("<Other/>"), nil)
+	if !errors.Is(err, network.ErrNoRecordedInteraction) {
+		t.Errorf("PostSoapRequest need ErrNoRecordedInteraction for unmatched body, got %v", err)
+	}
+}
+
+func TestRecorderCompressed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(`{"token":"secret"}`))
+		gz.Close()
+	}))
+	defer server.Close()
+	fixture := t.TempDir() + "/recorder.json"
+	recorder, err := network.NewRecorder(fixture, network.RecordModeRecord)
+	if err != nil {
+		t.Fatalf("NewRecorder error: %v", err)
+	}
+	recorder.Redact = func(interaction *network.Interaction) {
+		interaction.Request.Body = strings.Replace(interaction.Request.Body, "secret", "REDACTED", -1)
+		interaction.Response.Body = strings.Replace(interaction.Response.Body, "secret", "REDACTED", -1)
+	}
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	httpClient.Compression = &network.Compression{Encoding: "gzip", MinSize: 1}
+	httpClient.Recorder = recorder
+	_, resBody, err := httpClient.PostBodyRequest(server.URL, `{"password":"secret"}`, nil)
+	if err != nil || resBody["token"] != "secret" {
+		t.Errorf("PostBodyRequest in record mode error: %v, body: %v", err, resBody)
+	}
+	data, _ := ioutil.ReadFile(fixture)
+	if bytes.Contains(data, []byte("secret")) || !bytes.Contains(data, []byte(`\"token\":\"REDACTED\"`)) ||
+		!bytes.Contains(data, []byte(`\"password\":\"REDACTED\"`)) {
+		t.Errorf("fixture need plain bodies redacted by Redact: %s", data)
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		case "/html":
+			w.Write([]byte("<html></html>"))
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not found"}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"upstream"}`))
+		}
+	}))
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsServer.Close()
+	closedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closedServer.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+
+	status, _, err := httpClient.GetQueryRequest(server.URL+"/upstream", nil, nil)
+	if status != 500 || err != nil {
+		t.Errorf("upstream 500 need status 500 without error, got %d, %v", status, err)
+	}
+	var requestErr *network.RequestError
+	status, _, err = httpClient.PostBodyRequest("http://[::1", "{}", nil)
+	if status != 0 || !errors.Is(err, network.ErrRequest) || !errors.As(err, &requestErr) || requestErr.Method != "POST" {
+		t.Errorf("invalid url need status 0 and RequestError, got %d, %v", status, err)
+	}
+	status, _, err = httpClient.GetQueryRequest(closedServer.URL, nil, nil)
+	if status != 0 || !errors.Is(err, network.ErrTransport) || errors.Is(err, network.ErrTimeout) || errors.Is(err, network.ErrTLS) {
+		t.Errorf("connection refused need status 0 and TransportError, got %d, %v", status, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	status, _, err = httpClient.SendQueryRequestWithContext(ctx, "GET", server.URL+"/slow", nil, nil)
+	if status != 0 || !errors.Is(err, network.ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("deadline need status 0 and ErrTimeout, got %d, %v", status, err)
+	}
+	status, _, err = httpClient.GetQueryRequest(tlsServer.URL, nil, nil)
+	if status != 0 || !errors.Is(err, network.ErrTLS) {
+		t.Errorf("unknown certificate need status 0 and ErrTLS, got %d, %v", status, err)
+	}
+	status, _, err = httpClient.GetQueryRequest(server.URL+"/html", nil, nil)
+	if status != 200 || !errors.Is(err, network.ErrDecode) {
+		t.Errorf("html body need ErrDecode, got %d, %v", status, err)
+	}
+	var fileErr *network.FileError
+	status, _, err = httpClient.PostFormDataWithFilesRequest(server.URL, nil, []network.SendFile{{ParamName: "file", Paths: []string{"not_exist.txt"}}}, nil)
+	if status != 0 || !errors.Is(err, network.ErrFileIO) || !errors.As(err, &fileErr) || fileErr.Path != "not_exist.txt" || !os.IsNotExist(fileErr.Err) {
+		t.Errorf("missing file need status 0 and FileError, got %d, %v", status, err)
+	}
+	var statusErr *network.StatusError
+	err = httpClient.DownloadFile(server.URL+"/missing", t.TempDir()+"/missing.json", nil)
+	if !errors.Is(err, network.ErrStatus) || !errors.As(err, &statusErr) || statusErr.StatusCode != 404 || string(statusErr.Body) != `{"error":"not found"}` {
+		t.Errorf("DownloadFile need StatusError of 404, got %v", err)
+	}
+	err = httpClient.DownloadFile(server.URL+"/html", t.TempDir()+"/no_dir/file.html", nil)
+	if !errors.Is(err, network.ErrFileIO) {
+		t.Errorf("DownloadFile to a missing directory need ErrFileIO, got %v", err)
+	}
+
+	// errors of the middlewares are not transport errors
+	fixture := t.TempDir() + "/empty.json"
+	ioutil.WriteFile(fixture, []byte("[]"), 0644)
+	recorder, _ := network.NewRecorder(fixture, network.RecordModeReplay)
+	httpClient.Recorder = recorder
+	status, _, err = httpClient.GetQueryRequest(server.URL, nil, nil)
+	if status != 0 || !errors.Is(err, network.ErrMiddleware) || !errors.Is(err, network.ErrNoRecordedInteraction) || errors.Is(err, network.ErrTransport) {
+		t.Errorf("unmatched replay need status 0 and MiddlewareError, got %d, %v", status, err)
+	}
+	httpClient.Recorder = nil
+	rejected := errors.New("rejected by interceptor")
+	httpClient.Use(network.RequestInterceptor(func(req *http.Request) error {
+		return rejected
+	}))
+	var middlewareErr *network.MiddlewareError
+	status, _, err = httpClient.GetQueryRequest(server.URL, nil, nil)
+	if status != 0 || !errors.As(err, &middlewareErr) || !errors.Is(err, rejected) || errors.Is(err, network.ErrTransport) {
+		t.Errorf("interceptor error need status 0 and MiddlewareError, got %d, %v", status, err)
+	}
+
+	// a TLS alert of the server is a TLS error
+	mtlsServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	mtlsServer.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert, MaxVersion: tls.VersionTLS12}
+	mtlsServer.StartTLS()
+	defer mtlsServer.Close()
+	tlsClient := network.NewHttpClient(10, false, true)
+	defer tlsClient.Close()
+	tlsClient.SetTLSConfig(&network.TLSConfig{CAPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: mtlsServer.Certificate().Raw})})
+	status, _, err = tlsClient.GetQueryRequest(mtlsServer.URL, nil, nil)
+	if status != 0 || !errors.Is(err, network.ErrTLS) {
+		t.Errorf("tls alert need status 0 and ErrTLS, got %d, %v", status, err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	var encodings []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		body := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = gz
+		}
+		data, _ := ioutil.ReadAll(body)
+		resBody := []byte(`{"size":` + strconv.Itoa(len(data)) + `}`)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Query().Get("encoding") {
+		case "gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write(resBody)
+			gz.Close()
+		case "deflate":
+			w.Header().Set("Content-Encoding", "deflate")
+			zw := zlib.NewWriter(w)
+			zw.Write(resBody)
+			zw.Close()
+		default:
+			w.Write(resBody)
+		}
+	}))
+	defer server.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	httpClient.Compression = network.NewCompression("gzip")
+
+	large := `{"data":"` + strings.Repeat("a", 2048) + `"}`
+	status, resBody, err := httpClient.PostBodyRequest(server.URL, large, nil)
+	if err != nil || status != 200 || resBody["size"] != float64(len(large)) {
+		t.Errorf("compressed request error: %v, status: %d, body: %v", err, status, resBody)
+	}
+	status, resBody, err = httpClient.PostBodyRequest(server.URL, `{"data":"a"}`, nil)
+	if err != nil || status != 200 || resBody["size"] != float64(12) {
+		t.Errorf("small request error: %v, status: %d, body: %v", err, status, resBody)
+	}
+	if len(encodings) != 2 || encodings[0] != "gzip" || encodings[1] != "" {
+		t.Errorf("only the large body need gzip, got %v", encodings)
+	}
+	// the caller asks for gzip, which stops http.Transport decompressing the response
+	for _, encoding := range []string{"gzip", "deflate"} {
+		status, resBody, err = httpClient.GetQueryRequest(server.URL+"?encoding="+encoding, nil, map[string]string{"Accept-Encoding": encoding})
+		if err != nil || status != 200 || resBody["size"] != float64(0) {
+			t.Errorf("%s response error: %v, status: %d, body: %v", encoding, err, status, resBody)
+		}
+	}
+	httpClient.Compression = &network.Compression{Encoding: "br"}
+	if _, _, err := httpClient.PostBodyRequest(server.URL, large, nil); err == nil {
+		t.Errorf("unsupported encoding need an error")
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	large := `{"data":"` + strings.Repeat("a", 100) + `"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked" {
+			// without Content-Length
+			w.Write([]byte(large[:50]))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(large[50:]))
+			return
+		}
+		w.Write([]byte(large))
+	}))
+	defer server.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	httpClient.MaxResponseSize = 64
+
+	var tooLarge *network.ResponseTooLargeError
+	for _, path := range []string{"/", "/chunked"} {
+		status, _, err := httpClient.GetQueryRequest(server.URL+path, nil, nil)
+		if status != 200 || !errors.Is(err, network.ErrResponseTooLarge) || !errors.As(err, &tooLarge) || tooLarge.Limit != 64 {
+			t.Errorf("%s need ResponseTooLargeError, got %d, %v", path, status, err)
+		}
+	}
+	if _, _, err := httpClient.SendSoapRequest("GET", server.URL+"/chunked", nil, nil); !errors.Is(err, network.ErrResponseTooLarge) {
+		t.Errorf("SendSoapRequest need ErrResponseTooLarge, got %v", err)
+	}
+	if _, err := httpClient.SendJSONRequest("GET", server.URL, nil, &struct{}{}, nil); !errors.Is(err, network.ErrResponseTooLarge) {
+		t.Errorf("SendJSONRequest need ErrResponseTooLarge, got %v", err)
+	}
+	ctx := network.WithMaxResponseSize(context.Background(), 0)
+	if status, resBody, err := httpClient.SendQueryRequestWithContext(ctx, "GET", server.URL, nil, nil); err != nil || status != 200 || len(resBody["data"].(string)) != 100 {
+		t.Errorf("WithMaxResponseSize 0 need no limit, got %d, %v", status, err)
+	}
+
+	// streaming is not limited by MaxResponseSize
+	status, body, err := httpClient.SendStreamRequest("GET", server.URL+"/chunked", nil, nil)
+	if err != nil || status != 200 {
+		t.Fatalf("SendStreamRequest error: %v, status: %d", err, status)
+	}
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil || string(data) != large {
+		t.Errorf("stream body error: %v, body: %s", err, data)
+	}
+	req, _ := http.NewRequestWithContext(network.WithMaxResponseSize(context.Background(), 80), "GET", server.URL+"/chunked", nil)
+	res, err := httpClient.DoStream(req)
+	if err != nil || res.StatusCode != 200 || res.Header.Get("Content-Type") == "" {
+		t.Fatalf("DoStream error: %v", err)
+	}
+	data, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if !errors.Is(err, network.ErrResponseTooLarge) || string(data) != large[:80] {
+		t.Errorf("DoStream with limit need ErrResponseTooLarge after 80 bytes, got %v, %d bytes", err, len(data))
+	}
+}
+
+func TestInsecureSkipVerifyWarning(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+	// the logger is set after the client is created
+	httpClient := network.NewHttpClient(10, true, true)
+	defer httpClient.Close()
+	buf := &bytes.Buffer{}
+	httpClient.Logger = logger.NewTextLogger(buf, logger.LevelWarn)
+	for i := 0; i < 2; i++ {
+		if status, _, err := httpClient.GetQueryRequest(server.URL, nil, nil); err != nil || status != 200 {
+			t.Fatalf("GetQueryRequest with InsecureSkipVerify error: %v, status: %d", err, status)
+		}
+		// the next request makes a new connection
+		httpClient.Close()
+	}
+	if n := strings.Count(buf.String(), "tls certificate verification is disabled"); n != 1 {
+		t.Errorf("insecure requests need one warning of the client logger, got %d, log: %s", n, buf.String())
+	}
+}
+
+func TestStreamTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/late" {
+			time.Sleep(1500 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < 5; i++ {
+			w.Write([]byte("0123456789"))
+			w.(http.Flusher).Flush()
+			time.Sleep(300 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+	httpClient := network.NewHttpClient(1, false, true)
+	defer httpClient.Close()
+
+	// the body takes longer than TimeoutSeconds
+	status, body, err := httpClient.SendStreamRequest("GET", server.URL, nil, nil)
+	if err != nil || status != 200 {
+		t.Fatalf("SendStreamRequest error: %v, status: %d", err, status)
+	}
+	data, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil || len(data) != 50 {
+		t.Errorf("stream body need to be read beyond the client timeout, error: %v, size: %d", err, len(data))
+	}
+	// TimeoutSeconds still limits the time until the headers are received
+	if _, _, err := httpClient.SendStreamRequest("GET", server.URL+"/late", nil, nil); !errors.Is(err, network.ErrTimeout) {
+		t.Errorf("late headers need ErrTimeout, got %v", err)
+	}
+	// the context of the request bounds the body
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, body, err = httpClient.SendStreamRequestWithContext(ctx, "GET", server.URL, nil, nil)
+	if err != nil {
+		t.Fatalf("SendStreamRequestWithContext error: %v", err)
+	}
+	_, err = ioutil.ReadAll(body)
+	body.Close()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("stream body need to stop at the deadline of the context, got %v", err)
+	}
+}
+
+func TestCredentialsOnRedirect(t *testing.T) {
+	type received struct{ auth, signature, body string }
+	var other received
+	otherServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		other = received{r.Header.Get("Authorization"), r.Header.Get("X-Signature"), string(body)}
+		w.Write([]byte(`{}`))
+	}))
+	defer otherServer.Close()
+	var same received
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/same":
+			body, _ := ioutil.ReadAll(r.Body)
+			same = received{r.Header.Get("Authorization"), r.Header.Get("X-Signature"), string(body)}
+			w.Write([]byte(`{}`))
+		case "/to-same":
+			http.Redirect(w, r, "/same", http.StatusTemporaryRedirect)
+		default:
+			http.Redirect(w, r, otherServer.URL+"/other", http.StatusTemporaryRedirect)
+		}
+	}))
+	defer server.Close()
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"s3cr3t","token_type":"bearer","expires_in":3600}`))
+	}))
+	defer tokenServer.Close()
+	httpClient := network.NewHttpClient(10, false, true)
+	defer httpClient.Close()
+	httpClient.TokenSource = network.NewClientCredentialsTokenSource(httpClient, network.OAuth2Config{TokenURL: tokenServer.URL, ClientID: "id"})
+	httpClient.Signer = network.NewHMACSigner("partner", []byte("secret"))
+	httpClient.WSSecurity = &network.WSSecurity{Username: "his", Password: "p@ss"}
+	envelope := []byte(`<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body><Add/></soap:Body></soap:Envelope>`)
+
+	if _, _, err := httpClient.PostSoapRequest(server.URL+"/to-same", envelope, nil); err != nil {
+		t.Fatalf("redirect to the same host error: %v", err)
+	}
+	if same.auth != "Bearer s3cr3t" || same.signature == "" || !strings.Contains(same.body, "UsernameToken") {
+		t.Errorf("redirect to the same host need the credentials, got %+v", same)
+	}
+	if _, _, err := httpClient.PostSoapRequest(server.URL+"/to-other", envelope, nil); err != nil {
+		t.Fatalf("redirect to another host error: %v", err)
+	}
+	if other.auth != "" || other.signature != "" || strings.Contains(other.body, "UsernameToken") || other.body != string(envelope) {
+		t.Errorf("redirect to another host need no credentials, got %+v", other)
+	}
+}
@@ -1,6 +1,7 @@
 package test_tests
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -22,14 +23,20 @@ func TestErrorHandler(t *testing.T) {
 }
 
 func TestHttpRequest(t *testing.T) {
+	// replay the responses recorded by network.RecordModeRecord, use it to record them again
+	recorder, err := network.NewRecorder("fixtures/http_request.json", network.RecordModeReplay)
+	if err != nil {
+		t.Fatalf("network.NewRecorder error: %v", err)
+	}
 	httpClient := network.NewHttpClient(10, true, true)
 	defer httpClient.Close()
+	httpClient.Recorder = recorder
 	scode, _, err := httpClient.GetQueryRequest("https://www.google.com.tw", nil, nil)
-	if scode >= 400 {
+	if scode != 200 || errors.Is(err, network.ErrNoRecordedInteraction) {
 		t.Errorf("network.GetQueryRequest https://www.google.com.tw, scode: %d, error: %v, need scode = 200", scode, err)
 	}
 	scode, _, err = httpClient.GetQueryRequest("https://www.amazon.com", nil, nil)
-	if scode >= 400 {
+	if scode != 200 || errors.Is(err, network.ErrNoRecordedInteraction) {
 		t.Errorf("network.GetQueryRequest https://www.amazon.com, scode: %d, error: %v, need scode = 200", scode, err)
 	}
 }
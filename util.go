@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"os"
 	"os/exec"
@@ -101,7 +100,7 @@ func SetRequestBodyParams(body io.ReadCloser) (map[string]interface{}, error) {
 	params := make(map[string]interface{})
 	err := json.Unmarshal(bodyBytes, &params)
 	if err != nil {
-		fmt.Println("error:", err)
+		getLogger().Error("SetRequestBodyParams json unmarshal error", "error", err)
 	}
 	return params, err
 }
@@ -254,8 +253,8 @@ func ExecuteBackground(cmdstr string, args ...string) (int, error) {
 	go func() {
 		err = cmd.Wait()
 		if err != nil {
-			log.Println("ExecuteBackground error: " + cmdstr + fmt.Sprintf(" %v"+err.Error()))
-			log.Printf("stdout: %q, stderr: %q\n", stdout.String(), stderr.String())
+			getLogger().Error("ExecuteBackground error", "command", cmdstr, "args", args, "error", err,
+				"stdout", stdout.String(), "stderr", stderr.String())
 		}
 	}()
 	return cmd.Process.Pid, nil
@@ -355,7 +354,7 @@ func GetSystemLanguage() string {
 		cmd := exec.Command("powershell", "-c", "Get-WinSystemLocale")
 		output, err := cmd.Output()
 		if err != nil {
-			fmt.Println("error:", err)
+			getLogger().Error("GetSystemLanguage Get-WinSystemLocale error", "error", err)
 			return "en"
 		}
 		stdout := strings.ToLower(string(output))
@@ -375,7 +374,7 @@ func GetSystemLanguage() string {
 	case "darwin":
 		return getLangFromUnixSystem()
 	default:
-		fmt.Println("Others OS")
+		getLogger().Warn("GetSystemLanguage unsupported os", "os", os)
 		return "en"
 	}
 }
@@ -384,7 +383,7 @@ func getLangFromUnixSystem() string {
 	cmd := exec.Command("locale")
 	output, err := cmd.Output()
 	if err != nil {
-		fmt.Println("error:", err)
+		getLogger().Error("GetSystemLanguage locale error", "error", err)
 		return "en"
 	}
 	stdout := strings.ToLower(string(output))